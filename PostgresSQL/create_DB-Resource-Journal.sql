@@ -29,6 +29,31 @@ create table if not exists "Resources" (
 
 create index if not exists "IX_Resources_OwnerId" ON "Resources" ("OwnerId");
 
+-- user-defined types for the DB_CUSTOM_TYPES tests
+create type public.mood as enum ('sad', 'ok', 'happy');
+create domain public.positive_int as integer check (value > 0);
+create type public.address as ("street" text, "mood" public.mood, "rating" public.positive_int);
+
+-- raises the given SQLSTATE (or returns 1 for 00000), for the database error mapping tests
+create or replace function public.raise_sqlstate(code text) returns integer language plpgsql as $$
+begin
+    if code <> '00000' then
+        raise exception 'raised for the tests: %', code using errcode = code;
+    end if;
+    return 1;
+end
+$$;
+
+-- fails with a lost connection (SQLSTATE 08006) on connections named failover-replica, for the replica failover test
+create or replace function public.fail_on_replica() returns text language plpgsql as $$
+begin
+    if current_setting('application_name') = 'failover-replica' then
+        raise exception 'simulated replica failure' using errcode = '08006';
+    end if;
+    return 'primary';
+end
+$$;
+
 --select * from public."Journal";
 --select * from public."Resources";
 
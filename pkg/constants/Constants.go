@@ -17,12 +17,95 @@ const (
 
 const (
 	DB_CONNECTION_STRING  = "DB_CONNECTSTRING"
+	DB_CUSTOM_TYPES       = "DB_CUSTOM_TYPES"
+	POSTGIS_ENABLED       = "POSTGIS_ENABLED"
 	QUERIES_FILE          = "/Resources/Queries.json"
 	PUBLIC_QUERIES_FILE   = "/Resources/Public.Queries.json"
 	INTERNAL_SERVER_ERROR = "Internal Server Error: "
 	NPG_EXCEPTION_MESSAGE = "Postgres Error detected while calling: %s\n\t Error - %s See https://www.postgresql.org/docs/current/errcodes-appendix.html for additional details"
 )
 
+const (
+	DB_REPLICA_CONNECTSTRINGS          = "DB_REPLICA_CONNECTSTRINGS"
+	DB_REPLICA_HEALTH_INTERVAL_SECONDS = "DB_REPLICA_HEALTH_INTERVAL_SECONDS"
+)
+
+// named datasources are configured as DATASOURCES.<name>.connectstring (and .replicas, .customtypes
+// and .postgis, the datasource's DB_CUSTOM_TYPES and POSTGIS_ENABLED)
+const (
+	DATASOURCES              = "DATASOURCES"
+	DATASOURCE_CONNECTSTRING = "connectstring"
+	DATASOURCE_REPLICAS      = "replicas"
+	DATASOURCE_CUSTOM_TYPES  = "customtypes"
+	DATASOURCE_POSTGIS       = "postgis"
+)
+
+const (
+	DB_RETRY_MAX_ATTEMPTS   = "DB_RETRY_MAX_ATTEMPTS"
+	DB_RETRY_BACKOFF_MS     = "DB_RETRY_BACKOFF_MS"
+	DB_RETRY_MAX_BACKOFF_MS = "DB_RETRY_MAX_BACKOFF_MS"
+	DB_ACQUIRE_TIMEOUT_MS   = "DB_ACQUIRE_TIMEOUT_MS"
+)
+
+const (
+	CIRCUIT_BREAKER_FAILURES     = "CIRCUIT_BREAKER_FAILURES"
+	CIRCUIT_BREAKER_ERROR_RATE   = "CIRCUIT_BREAKER_ERROR_RATE"
+	CIRCUIT_BREAKER_WINDOW       = "CIRCUIT_BREAKER_WINDOW"
+	CIRCUIT_BREAKER_OPEN_SECONDS = "CIRCUIT_BREAKER_OPEN_SECONDS"
+)
+
+// requests per second allowed for each caller identity (or client address) across a store's methods
+const (
+	RATE_LIMIT_PER_CALLER = "RATE_LIMIT_PER_CALLER"
+	RATE_LIMIT_BURST      = "RATE_LIMIT_BURST"
+	TRUST_X_FORWARDED_FOR = "TRUST_X_FORWARDED_FOR"
+)
+
+const (
+	SHARD_DATASOURCES   = "SHARD_DATASOURCES"
+	SHARD_PARTITION_MAP = "SHARD_PARTITION_MAP"
+)
+
+const (
+	SLOW_QUERY_THRESHOLD_MS          = "SLOW_QUERY_THRESHOLD_MS"
+	SLOW_QUERY_EXPLAIN               = "SLOW_QUERY_EXPLAIN"
+	SLOW_QUERY_EXPLAIN_SAMPLE_RATE   = "SLOW_QUERY_EXPLAIN_SAMPLE_RATE"
+	SLOW_QUERY_EXPLAIN_MAX_IN_FLIGHT = "SLOW_QUERY_EXPLAIN_MAX_IN_FLIGHT"
+)
+
+const (
+	TIMESTAMP_FORMAT    = "TIMESTAMP_FORMAT"
+	DATE_FORMAT         = "DATE_FORMAT"
+	TIMESTAMP_TIME_ZONE = "TIMESTAMP_TIME_ZONE"
+)
+
+const (
+	MAX_RESULT_ROWS    = "MAX_RESULT_ROWS"
+	MAX_RESPONSE_BYTES = "MAX_RESPONSE_BYTES"
+)
+
+const (
+	RESULT_CACHE_MAX_ENTRIES = "RESULT_CACHE_MAX_ENTRIES"
+	RESULT_CACHE_MAX_BYTES   = "RESULT_CACHE_MAX_BYTES"
+)
+
+const (
+	COMPRESSION_ENCODINGS = "COMPRESSION_ENCODINGS"
+	COMPRESSION_MIN_BYTES = "COMPRESSION_MIN_BYTES"
+)
+
 const (
 	HTTP_GET = "GET"
 )
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id"
+	TIMEZONE_HEADER   = "X-Timezone"
+	TRUNCATED_HEADER  = "X-Result-Truncated"
+
+	ETAG_HEADER          = "ETag"
+	IF_NONE_MATCH_HEADER = "If-None-Match"
+	CACHE_CONTROL_HEADER = "Cache-Control"
+	RETRY_AFTER_HEADER   = "Retry-After"
+	FORWARDED_FOR_HEADER = "X-Forwarded-For"
+)
@@ -3,27 +3,42 @@ package implementations
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
 	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 // type BaseQueryStore[T interfaces.IQueryStore] struct {
 type BaseQueryStore struct {
+	name            string
 	dbConnectString string
 	Methods         []models.Method
 	logger          *logrus.Logger
 	dbPool          *pgxpool.Pool
+	datasources     map[string]*datasource
+	shards          *shardMap
 	rootCtx         *context.Context
 	cancel          *context.CancelFunc
 	debugLevel      int
+	metrics         *QueryMetrics
+	slowQueries     *SlowQueryLog
+	readerDefaults  ReaderOptions
+	retries         RetryPolicy
+	resultCache     *ResultCache
+	rateLimits      *RateLimits
+	flights         singleflight.Group
 }
 
 // NewPrivateQueryStore is the constructor for PrivateQueryStore, similar to the C# constructor
@@ -66,25 +81,44 @@ func NewBaseQueryStore(configuration *viper.Viper, logger *logrus.Logger, fileNa
 		debugLevel = configuration.GetInt(constants.DEBUGSIFTD_QUERYSTORE)
 	}
 
-	store := &BaseQueryStore{logger: logger, debugLevel: debugLevel}
+	store := &BaseQueryStore{
+		name:       storeNameFromFile(fileName),
+		logger:     logger,
+		debugLevel: debugLevel,
+		metrics:    GetQueryMetrics(),
+	}
 
 	store.dbConnectString = configuration.GetString(constants.DB_CONNECTION_STRING)
 	if store.dbConnectString == "" {
 		return nil, fmt.Errorf("queryservice store - unable to retrieve database connection string")
 	}
 
-	// Initialize the database pool (example with pgx)
-	connConfig, err := pgxpool.ParseConfig(store.dbConnectString)
-	if err != nil {
-		return nil, fmt.Errorf("queryservice store - unable to parse connection config: %v", err)
-	}
 	rootCtx, cancel := context.WithCancel(context.Background())
 	store.rootCtx = &rootCtx
 	store.cancel = &cancel
 
-	connConfig.MaxConnIdleTime = 60 * time.Second
-	connConfig.MaxConnLifetime = 60 * time.Second
-	connConfig.MaxConns = 15
+	readerDefaults, err := NewDefaultReaderOptions(configuration)
+	if err != nil {
+		return nil, err
+	}
+	store.readerDefaults = readerDefaults
+
+	store.retries, err = NewRetryPolicy(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	// the types registered on each connection of the default datasource's pools
+	types, err := newDatasourceTypes(configuration, constants.DB_CUSTOM_TYPES, constants.POSTGIS_ENABLED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize the database pool (example with pgx)
+	connConfig, err := newPoolConfig(store.dbConnectString, store.name, PRIMARY_POOL, types.afterConnect)
+	if err != nil {
+		return nil, fmt.Errorf("queryservice store - unable to parse connection config: %v", err)
+	}
 
 	//	defer cancel()
 
@@ -101,6 +135,39 @@ func NewBaseQueryStore(configuration *viper.Viper, logger *logrus.Logger, fileNa
 	}
 	logger.Info("queryservice store - successfully connected to database")
 
+	defaultSource := &datasource{types: types}
+	store.addPrimary(defaultSource, store.dbPool)
+	store.datasources = map[string]*datasource{"": defaultSource}
+
+	// read replicas for methods whose consistency allows them, and the other databases that
+	// serviceNames may be bound to
+	err = store.connectReplicas(configuration, defaultSource, constants.DB_REPLICA_CONNECTSTRINGS)
+	if err != nil {
+		return nil, err
+	}
+	err = store.connectDatasources(configuration)
+	if err != nil {
+		return nil, err
+	}
+	store.startReplicaMonitor(configuration)
+
+	err = store.attachCircuitBreakers(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	store.shards, err = newShardMap(configuration, store.datasources)
+	if err != nil {
+		return nil, err
+	}
+
+	store.resultCache = NewResultCache(configuration, store.name, store.metrics)
+	store.rateLimits, err = NewRateLimits(configuration)
+	if err != nil {
+		return nil, err
+	}
+	store.slowQueries = NewSlowQueryLog(configuration, logger, store.name, *store.rootCtx)
+
 	if !(fileName == "healthcheck:skip-load") {
 		if store.debugLevel > 0 {
 			logger.Info("queryservice store - Loading queries from file: ", fileName)
@@ -115,6 +182,20 @@ func NewBaseQueryStore(configuration *viper.Viper, logger *logrus.Logger, fileNa
 	return store, nil
 }
 
+// storeNameFromFile returns the name used to label this store's metrics
+func storeNameFromFile(fileName string) string {
+	switch {
+	case fileName == "healthcheck:skip-load":
+		return "healthcheck"
+	case strings.HasSuffix(fileName, constants.PUBLIC_QUERIES_FILE):
+		return "public"
+	case strings.HasSuffix(fileName, constants.QUERIES_FILE):
+		return "secured"
+	default:
+		return filepath.Base(fileName)
+	}
+}
+
 func (store *BaseQueryStore) loadQueries(queryFile string) error {
 	fileData, err := os.ReadFile(queryFile)
 	if err != nil {
@@ -129,9 +210,35 @@ func (store *BaseQueryStore) loadQueries(queryFile string) error {
 		return err
 	}
 
+	serviceDatasources := store.bindServiceDatasources(methods)
+
 	for _, m := range methods {
-		if m.ValidateQueryParamsWithQuery(store.logger) {
+		datasourceName, bound := serviceDatasources[m.ServiceName]
+		if !bound {
+			store.logger.Infof("queryservice store - skipping method %s: service %s has conflicting datasources", m.MethodName, m.ServiceName)
+			continue
+		}
+		if _, ok := store.datasources[datasourceName]; !ok {
+			store.logger.Infof("queryservice store - skipping method %s: datasource %s is not configured under %s", m.MethodName, datasourceName, constants.DATASOURCES)
+			continue
+		}
+		m.Datasource = datasourceName
+
+		if (m.ShardKey != "" || m.ScatterGather) && store.shards == nil {
+			store.logger.Infof("queryservice store - skipping sharded method %s: %s is not configured", m.MethodName, constants.SHARD_DATASOURCES)
+			continue
+		}
+
+		if m.TimeZone != "" {
+			if _, err := cachedLocation(m.TimeZone); err != nil {
+				store.logger.Infof("queryservice store - invalid timeZone %s on method: %s (%v)", m.TimeZone, m.MethodName, err)
+				continue
+			}
+		}
+		if m.ValidateQueryParamsWithQuery(store.logger) && m.ValidateVersionQuery(store.logger) &&
+			m.ValidateShardSettings(store.logger) && m.ValidateRateLimits(store.logger) {
 			store.Methods = append(store.Methods, m)
+			store.rateLimits.addMethod(&m)
 		} else {
 			store.logger.Infof("queryservice store - query params validation failed for method: %s", m.MethodName)
 		}
@@ -140,6 +247,33 @@ func (store *BaseQueryStore) loadQueries(queryFile string) error {
 	return nil
 }
 
+// bindServiceDatasources works out the datasource of each serviceName. A datasource is declared on
+// any one of a service's methods and applies to all of them; services that declare none use the
+// default database. Services whose methods declare different datasources are left out of the map.
+func (store *BaseQueryStore) bindServiceDatasources(methods []models.Method) map[string]string {
+	bindings := make(map[string]string)
+	conflicts := make(map[string]bool)
+	for _, m := range methods {
+		if _, ok := bindings[m.ServiceName]; !ok {
+			bindings[m.ServiceName] = ""
+		}
+		datasourceName := strings.ToLower(strings.TrimSpace(m.Datasource))
+		if datasourceName == "" {
+			continue
+		}
+		if bound := bindings[m.ServiceName]; bound != "" && bound != datasourceName {
+			store.logger.Errorf("queryservice store - service %s is bound to both datasource %s and %s in the queries file", m.ServiceName, bound, datasourceName)
+			conflicts[m.ServiceName] = true
+		}
+		bindings[m.ServiceName] = datasourceName
+	}
+
+	for serviceName := range conflicts {
+		delete(bindings, serviceName)
+	}
+	return bindings
+}
+
 func (store *BaseQueryStore) GetQueryList() ([]byte, error) {
 	// Return the list of queries as json
 	jsonData, err := json.Marshal(store.Methods)
@@ -151,20 +285,74 @@ func (store *BaseQueryStore) GetQueryList() ([]byte, error) {
 	return jsonData, nil
 }
 
+// RunStandAloneQuery runs the query using the store's root context. Prefer RunStandAloneQueryWithContext
+// from http handlers so that request cancellation and trace context reach the database call.
 func (store *BaseQueryStore) RunStandAloneQuery(
 	serviceName string,
 	methodName string,
 	callParameters map[string]string) ([]byte, error) {
 
+	return store.RunStandAloneQueryWithContext(*store.rootCtx, serviceName, methodName, callParameters)
+}
+
+// RunStandAloneQueryWithContext runs the query and returns the json results.
+func (store *BaseQueryStore) RunStandAloneQueryWithContext(
+	ctx context.Context,
+	serviceName string,
+	methodName string,
+	callParameters map[string]string) ([]byte, error) {
+
+	result, err := store.RunStandAloneQueryWithResult(ctx, serviceName, methodName, callParameters)
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+// QueryResult is the outcome of a successful query request.
+type QueryResult struct {
+	Body      []byte // json array of the result rows
+	RowCount  int
+	Truncated bool // a maxRows/maxResponseBytes limit was reached and the remaining rows were dropped
+
+	ETag         string // strong entity tag of the results, quoted
+	CacheControl string // the method's cacheControl, if it has one
+	NotModified  bool   // the request's If-None-Match matched ETag; Body is not set
+
+	pool *storePool // the pool the query ran on; nil for scatter-gather results
+}
+
+// RunStandAloneQueryWithResult runs the query and returns the json results along with what the
+// routers need to know about them (e.g. whether they were truncated). Results of methods with a
+// cacheTtlSeconds may come from the result cache and are shared, so callers must not modify them.
+func (store *BaseQueryStore) RunStandAloneQueryWithResult(
+	ctx context.Context,
+	serviceName string,
+	methodName string,
+	callParameters map[string]string) (result *QueryResult, err error) {
+
 	serviceName = strings.TrimSpace(serviceName)
 	methodName = strings.TrimSpace(methodName)
 
+	start := time.Now()
+	metricsService, metricsMethod := undefinedMethodLabel, undefinedMethodLabel
+	rowCount := 0
+	var method *models.Method
+	var paramMap pgx.NamedArgs
+	var target *storePool
+	defer func() {
+		elapsed := time.Since(start)
+		store.metrics.ObserveRequest(store.name, metricsService, metricsMethod, elapsed, rowCount, err)
+		if method != nil {
+			store.slowQueries.Check(method, target, callParameters, paramMap, elapsed, rowCount, err)
+		}
+	}()
+
 	if store.debugLevel > 1 {
 		store.monitorPoolStats()
 	}
 
 	// Lookup the query to see if it exists
-	var method *models.Method
 	for _, m := range store.Methods {
 		if m.ServiceName == serviceName && m.MethodName == methodName {
 			method = &m
@@ -173,9 +361,264 @@ func (store *BaseQueryStore) RunStandAloneQuery(
 	}
 
 	if method == nil {
-		return nil, fmt.Errorf("queryservice store - unable to run the undefined service/method requested: %s/%s", serviceName, methodName)
+		return nil, NewQueryError(ERROR_NOT_FOUND,
+			fmt.Sprintf("queryservice store - unable to run the undefined service/method requested: %s/%s", serviceName, methodName), nil, nil)
+	}
+	metricsService, metricsMethod = method.ServiceName, method.MethodName
+
+	if scope, wait := store.rateLimits.take(ctx, method); wait > 0 {
+		store.metrics.ObserveRateLimited(store.name, method.ServiceName, method.MethodName, scope)
+		return nil, newRateLimitedError(scope, wait)
+	}
+
+	// Create the SQL query and execute it
+	// Multiple rows query
+	query := method.GetQueryStringInCallableFormat()
+
+	_, paramSpan := Tracer().Start(ctx, "queryservice.params.parse")
+	paramMap, err = store.parseCallParameters(method, callParameters)
+	if err != nil {
+		RecordSpanError(paramSpan, err)
+		paramSpan.End()
+		return nil, err
+	}
+	paramSpan.End()
+
+	// the parameters are checked before the cache is, so an invalid request never gets a cached result
+	key := requestKey(ctx, method, callParameters)
+	var cacheKey string
+	if method.CacheTtlSeconds > 0 {
+		cacheKey = key
+		cachedResult, hit := store.resultCache.Get(cacheKey)
+		store.metrics.ObserveCacheLookup(store.name, method.ServiceName, method.MethodName, hit)
+		trace.SpanFromContext(ctx).SetAttributes(ATTR_CACHE_HIT.Bool(hit))
+		if hit {
+			rowCount = cachedResult.RowCount
+			return notModified(ctx, cachedResult), nil
+		}
+	}
+
+	if store.debugLevel > 0 {
+		store.logger.Info("queryservice store - Query: ", query)
+		store.logger.Info("queryservice store - Query params: ", paramMap)
+	}
+
+	options, err := store.readerOptions(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := store.targetsFor(method, callParameters)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 1 {
+		target = targets[0]
+	}
+	trace.SpanFromContext(ctx).SetAttributes(ATTR_DB_POOL.String(poolNames(targets)))
+
+	// the version is read before the results, so the ETag can only be older than the data it is
+	// sent with; a change that lands in between is picked up on the next request
+	var etag string
+	if method.VersionQuery != "" {
+		etag, err = store.versionETag(ctx, method, targets, key, paramMap, options)
+		if err != nil {
+			if target != nil {
+				target = ranOn(target, nil, err)
+			}
+			return nil, err
+		}
+		if etagMatches(IfNoneMatch(ctx), etag) {
+			return &QueryResult{ETag: etag, CacheControl: method.CacheControl, NotModified: true}, nil
+		}
+	}
+
+	execute := func(ctx context.Context) (*QueryResult, error) {
+		return store.executeQuery(ctx, method, targets, query, paramMap, options, cacheKey, etag)
+	}
+	if method.ReadOnly {
+		result, err = store.coalesce(ctx, method, key, execute)
+	} else {
+		result, err = execute(ctx)
+	}
+	// the slow-query log reports the pool the query ended up on, e.g. after a replica failed over
+	if target != nil {
+		target = ranOn(target, result, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rowCount = result.RowCount
+	trace.SpanFromContext(ctx).SetAttributes(ATTR_RESULT_ROWS.Int(rowCount))
+
+	return notModified(ctx, result), nil
+}
+
+// executeQuery runs the query on its target pool (or on every shard, for scatter-gather methods),
+// converts any failure into a QueryError that is safe to return to the caller, and caches the result
+// when the method has a cacheTtlSeconds. The result is tagged with etag, or with a hash of its body
+// when the method has no version query.
+func (store *BaseQueryStore) executeQuery(
+	ctx context.Context,
+	method *models.Method,
+	targets []*storePool,
+	query string,
+	paramMap pgx.NamedArgs,
+	options ReaderOptions,
+	cacheKey string,
+	etag string) (*QueryResult, error) {
+
+	var result *QueryResult
+	var err error
+	if len(targets) == 1 {
+		result, err = store.runQueryWithRetries(ctx, method, targets[0], query, paramMap, options)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		result, err = store.scatterGather(ctx, method, targets, query, paramMap, options)
+		if err != nil {
+			return nil, err
+		}
 	}
+	if store.debugLevel > 0 {
+		store.logger.Info("queryservice store - Query result: ", string(result.Body))
+	}
+	if result.Truncated {
+		store.logger.Warnf("queryservice store - results of %s/%s truncated at %d rows by the method's limits", method.ServiceName, method.MethodName, result.RowCount)
+	}
+
+	if etag == "" {
+		etag = bodyETag(result.Body)
+	}
+	result.ETag = etag
+	result.CacheControl = method.CacheControl
+
+	if cacheKey != "" {
+		store.resultCache.Put(cacheKey, result, time.Duration(method.CacheTtlSeconds)*time.Second)
+	}
+
+	return result, nil
+}
+
+// toQueryError converts an error from running a query on target into a QueryError.
+func (store *BaseQueryStore) toQueryError(method *models.Method, target *storePool, err error) *QueryError {
+	// a result over the method's limits is already a QueryError
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return queryErr
+	}
+	// We don't pass the database error back to the caller. We log it and return a safe message
+	// (and status) based on the SQLSTATE. This is to prevent leaking sensitive information to the caller.
+	// Errors raised by the database while rows are streamed (e.g. a division by zero) arrive here too.
+	logDatabaseError(store.logger, method.ServiceName+"/"+method.MethodName+" on "+target.name, err)
+	return store.newPoolError(target, err)
+}
+
+// readerOptions combines the method's result settings with the service-wide defaults and the session
+// time zone passed in on the context (the X-Timezone header), which takes precedence over both.
+func (store *BaseQueryStore) readerOptions(ctx context.Context, method *models.Method) (ReaderOptions, error) {
+	options, err := NewReaderOptions(store.readerDefaults, method)
+	if err != nil {
+		return options, NewQueryError(ERROR_BACKEND, backendErrorMessage, nil, err)
+	}
+
+	if timeZone := SessionTimeZone(ctx); timeZone != "" {
+		location, err := cachedLocation(timeZone)
+		if err != nil {
+			return options, NewQueryError(ERROR_INVALID_PARAMS,
+				fmt.Sprintf("queryservice store - unknown time zone %q requested in the %s header", timeZone, constants.TIMEZONE_HEADER), nil, err)
+		}
+		options.Location = location
+	}
+
+	return options, nil
+}
+
+// runQuery executes the query on a connection from target's pool and reads every row. When the
+// request carries a session time zone the query runs in a transaction that sets TimeZone locally, so
+// the setting is never left behind on the pooled connection for the next request.
+func (store *BaseQueryStore) runQuery(ctx context.Context, target *storePool, query string, paramMap pgx.NamedArgs, options ReaderOptions) (*QueryResult, error) {
+	conn, err := store.acquire(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	options.types = target.types
+
+	// canceled when the read stops before the end of the results (a truncated result, a limit error),
+	// so that closing the rows does not wait for the database to send the rest of them
+	queryCtx, cancelQuery := context.WithCancel(ctx)
+	defer cancelQuery()
 
+	timeZone := SessionTimeZone(ctx)
+	if timeZone == "" {
+		rows, err := conn.Query(queryCtx, query, paramMap)
+		if err != nil {
+			return nil, err
+		}
+
+		tracked := &trackedRows{Rows: rows}
+		result, err := store.encodeRows(ctx, tracked, options)
+		if err != nil || result.Truncated {
+			cancelQuery()
+		}
+		rows.Close()
+		return result, tracked.afterRead(err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT set_config('TimeZone', $1, true)", timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(queryCtx, query, paramMap)
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedRows{Rows: rows}
+	result, err := store.encodeRows(ctx, tracked, options)
+	if err != nil || result.Truncated {
+		cancelQuery()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, tracked.afterRead(err)
+	}
+	if result.Truncated {
+		// the canceled query aborted the transaction, which the deferred Rollback ends; without the
+		// header the canceled statement is rolled back just the same
+		return result, nil
+	}
+
+	// committed rather than rolled back so that stored functions with side effects behave the same
+	// with or without the header
+	return result, tracked.afterRead(tx.Commit(ctx))
+}
+
+func (store *BaseQueryStore) encodeRows(ctx context.Context, rows pgx.Rows, options ReaderOptions) (*QueryResult, error) {
+	_, encodeSpan := Tracer().Start(ctx, "queryservice.json.encode")
+	defer encodeSpan.End()
+
+	result, err := NewSimpleReaderWithOptions(rows, store.logger, store.debugLevel, options).EncodeResponse()
+	if err != nil {
+		RecordSpanError(encodeSpan, err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseCallParameters checks the call parameters against the method definition and converts them into
+// the named args used on the query call.
+func (store *BaseQueryStore) parseCallParameters(method *models.Method, callParameters map[string]string) (pgx.NamedArgs, error) {
 	// Validate required parameters
 	missingParams := []string{}
 	for _, paramName := range method.GetQueryParameterNames(true) {
@@ -185,7 +628,8 @@ func (store *BaseQueryStore) RunStandAloneQuery(
 	}
 
 	if len(missingParams) > 0 {
-		return nil, fmt.Errorf("queryservice store - unable to run request due to missing required parameter(s): %s", strings.Join(missingParams, ", "))
+		return nil, NewQueryError(ERROR_MISSING_PARAMS,
+			fmt.Sprintf("queryservice store - unable to run request due to missing required parameter(s): %s", strings.Join(missingParams, ", ")), missingParams, nil)
 	}
 
 	// Validate extra parameters
@@ -205,61 +649,23 @@ func (store *BaseQueryStore) RunStandAloneQuery(
 	}
 
 	if len(extraParams) > 0 {
-		return nil, fmt.Errorf("queryservice store - unable to run request due to invalid input parameter(s) detected on request: %s", strings.Join(extraParams, ", "))
+		return nil, NewQueryError(ERROR_INVALID_PARAMS,
+			fmt.Sprintf("queryservice store - unable to run request due to invalid input parameter(s) detected on request: %s", strings.Join(extraParams, ", ")), extraParams, nil)
 	}
 
-	// Create the SQL query and execute it
-	// Multiple rows query
-	query := method.GetQueryStringInCallableFormat()
 	paramMap, err := method.GetMapOfParametersForQueryCall(callParameters) // TODO_PORT: the called func here needs to return both paramMap and error, then test it
 	if err != nil {
 		store.logger.Info("queryservice store - error creating parameter map for query: ", err)
-		return nil, fmt.Errorf("queryservice store - error creating parameter map for query: %w", err)
-	}
-
-	if store.debugLevel > 0 {
-		store.logger.Info("queryservice store - Query: ", query)
-		store.logger.Info("queryservice store - Query params: ", paramMap)
-	}
-
-	rows, err := store.dbPool.Query(*store.rootCtx, query, paramMap)
-	// rows, err := store.dbPool.Query(*store.rootCtx, query, ids)
-	if err != nil {
-		store.logger.Error("queryservice store - error detected on Query call: ", err)
-		// We don't pass the database error back to the caller. We log it and return a generic error message.
-		// This is to prevent leaking sensitive information to the caller.
-		return nil, fmt.Errorf(constants.INTERNAL_SERVER_ERROR + "A backend system error occurred in the queries service. Please check the logs")
-	}
-	defer rows.Close()
-
-	// Process the query results
-	sr := NewSimpleReader(rows, store.logger, store.debugLevel)
-	result, err := sr.ProcessResponse()
-	if err != nil {
-		// build empty result to return to caller
-		return []byte("[]"), fmt.Errorf("queryservice store - error encountered while processing query results: %w", err)
-	}
-	if store.debugLevel > 0 {
-		store.logger.Info("queryservice store - Query result: ", result)
-	}
-
-	jsonResults, err := json.Marshal(result)
-	if err != nil {
-		store.logger.Info("queryservice store - failed to marshal valid results returned from query: ", err)
-		jsonResults = ([]byte(err.Error()))
-		return jsonResults, fmt.Errorf("queryservice store - error encountered marshalling results returned for the query: %w", err)
-	}
-
-	// if no error, but no results, we return an empty array with a 200 status
-	if string(jsonResults) == "null" {
-		if store.debugLevel > 0 {
-			store.logger.Info("queryservice store - no results marshalled - forcing empty array")
+		var paramErr *models.ParameterError
+		var badParams []string
+		if errors.As(err, &paramErr) {
+			badParams = []string{paramErr.Name}
 		}
-		jsonResults = []byte("[]")
+		return nil, NewQueryError(ERROR_INVALID_PARAMS,
+			fmt.Sprintf("queryservice store - error creating parameter map for query: %v", err), badParams, err)
 	}
 
-	//	return result, nil // Replace with actual response from query execution
-	return jsonResults, nil // Replace with actual response from query execution
+	return paramMap, nil
 }
 
 func (store *BaseQueryStore) HealthCheck() error {
@@ -0,0 +1,39 @@
+package implementations
+
+import "context"
+
+type callerIdentityKey struct{}
+
+// WithCallerIdentity returns a context carrying the identity an identity-scoped request runs for.
+// The secured router sets it from the identityId in the url so that per-caller state (such as
+// result cache entries) is never shared between identities.
+func WithCallerIdentity(ctx context.Context, identityId string) context.Context {
+	if identityId == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, callerIdentityKey{}, identityId)
+}
+
+// CallerIdentity returns the identity set with WithCallerIdentity, or "" for requests that are not
+// identity scoped.
+func CallerIdentity(ctx context.Context) string {
+	identityId, _ := ctx.Value(callerIdentityKey{}).(string)
+	return identityId
+}
+
+type clientAddressKey struct{}
+
+// WithClientAddress returns a context carrying the address of the client that sent the request. It
+// identifies the caller for rate limiting on routes that are not identity scoped.
+func WithClientAddress(ctx context.Context, address string) context.Context {
+	if address == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAddressKey{}, address)
+}
+
+// ClientAddress returns the address set with WithClientAddress, or "" if none was set.
+func ClientAddress(ctx context.Context) string {
+	address, _ := ctx.Value(clientAddressKey{}).(string)
+	return address
+}
@@ -0,0 +1,320 @@
+package implementations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultCircuitFailures    = 5
+	defaultCircuitErrorRate   = 50
+	defaultCircuitWindow      = 20
+	defaultCircuitOpenSeconds = 30
+)
+
+// CircuitState is the state of a datasource's circuit breaker.
+type CircuitState int
+
+const (
+	CIRCUIT_CLOSED    CircuitState = iota // queries run as usual
+	CIRCUIT_HALF_OPEN                     // a single probe query is let through to see whether the database is back
+	CIRCUIT_OPEN                          // queries fail fast with 503 without waiting on the pool
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CIRCUIT_HALF_OPEN:
+		return "HALF_OPEN"
+	case CIRCUIT_OPEN:
+		return "OPEN"
+	default:
+		return "CLOSED"
+	}
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops queries from queuing on the pool of a datasource's primary while the database
+// is failing. It opens after CIRCUIT_BREAKER_FAILURES consecutive failed requests, or when at least
+// CIRCUIT_BREAKER_ERROR_RATE percent of the last CIRCUIT_BREAKER_WINDOW requests failed (either
+// trigger is turned off with 0); a request counts once however many times it was retried. After
+// CIRCUIT_BREAKER_OPEN_SECONDS it lets one probe request through, which closes it again if it
+// succeeds. Read replicas are not guarded by the breaker, since their health monitor already takes
+// them out of rotation.
+//
+// Breakers are shared by every store in the process, so the healthcheck store reports the state
+// the public and secured stores see.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	name        string
+	failures    int
+	errorRate   int
+	openFor     time.Duration
+	logger      *logrus.Logger
+	metrics     *QueryMetrics
+	state       CircuitState
+	openedAt    time.Time
+	probing     bool
+	consecutive int
+	outcomes    []bool // the recent queries, true for a failure; a ring buffer
+	next        int
+	recorded    int
+	failed      int
+}
+
+var (
+	circuitBreakers   = make(map[string]*circuitBreaker)
+	circuitBreakersMu sync.Mutex
+)
+
+// circuitBreakerTriggers reads the failure count and error rate that open a circuit; 0 turns either
+// trigger off.
+func circuitBreakerTriggers(configuration *viper.Viper) (int, int) {
+	failures, errorRate := defaultCircuitFailures, defaultCircuitErrorRate
+	if configuration.IsSet(constants.CIRCUIT_BREAKER_FAILURES) {
+		failures = configuration.GetInt(constants.CIRCUIT_BREAKER_FAILURES)
+	}
+	if configuration.IsSet(constants.CIRCUIT_BREAKER_ERROR_RATE) {
+		errorRate = configuration.GetInt(constants.CIRCUIT_BREAKER_ERROR_RATE)
+	}
+	return failures, errorRate
+}
+
+// circuitBreakersEnabled reports whether either trigger is on.
+func circuitBreakersEnabled(configuration *viper.Viper) bool {
+	failures, errorRate := circuitBreakerTriggers(configuration)
+	return failures > 0 || errorRate != 0
+}
+
+// getCircuitBreaker returns the process-wide circuit breaker of a datasource, creating it from
+// configuration on first use. It returns nil when both triggers are turned off.
+func getCircuitBreaker(configuration *viper.Viper, logger *logrus.Logger, metrics *QueryMetrics, name string) (*circuitBreaker, error) {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	if breaker, ok := circuitBreakers[name]; ok {
+		return breaker, nil
+	}
+
+	breaker := &circuitBreaker{
+		name:    name,
+		openFor: defaultCircuitOpenSeconds * time.Second,
+		logger:  logger,
+		metrics: metrics,
+	}
+	window := defaultCircuitWindow
+	breaker.failures, breaker.errorRate = circuitBreakerTriggers(configuration)
+	if breaker.errorRate < 0 || breaker.errorRate > 100 {
+		return nil, fmt.Errorf("queryservice store - %s must be a percentage, got %d", constants.CIRCUIT_BREAKER_ERROR_RATE, breaker.errorRate)
+	}
+	if size := configuration.GetInt(constants.CIRCUIT_BREAKER_WINDOW); size > 0 {
+		window = size
+	}
+	if seconds := configuration.GetInt(constants.CIRCUIT_BREAKER_OPEN_SECONDS); seconds > 0 {
+		breaker.openFor = time.Duration(seconds) * time.Second
+	}
+	if breaker.failures <= 0 && breaker.errorRate == 0 {
+		return nil, nil
+	}
+	breaker.outcomes = make([]bool, window)
+
+	circuitBreakers[name] = breaker
+	metrics.SetCircuitState(name, int(CIRCUIT_CLOSED))
+	return breaker, nil
+}
+
+// attachCircuitBreakers gives the primary of each of the store's datasources its circuit breaker.
+func (store *BaseQueryStore) attachCircuitBreakers(configuration *viper.Viper) error {
+	for name, ds := range store.datasources {
+		if name == "" {
+			name = DEFAULT_DATASOURCE
+		}
+		breaker, err := getCircuitBreaker(configuration, store.logger, store.metrics, name)
+		if err != nil {
+			return err
+		}
+		ds.primary.breaker = breaker
+	}
+	return nil
+}
+
+// allow reports whether a query may run, and whether it is the half-open circuit's probe.
+func (b *circuitBreaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CIRCUIT_CLOSED:
+		return false, nil
+	case CIRCUIT_OPEN:
+		if remaining := b.openFor - time.Since(b.openedAt); remaining > 0 {
+			return false, b.openError(remaining)
+		}
+		b.setState(CIRCUIT_HALF_OPEN)
+	}
+
+	if b.probing {
+		// the probe has not come back yet
+		return false, b.openError(time.Second)
+	}
+	b.probing = true
+	return true, nil
+}
+
+func (b *circuitBreaker) openError(retryAfter time.Duration) *QueryError {
+	queryErr := NewQueryError(ERROR_UNAVAILABLE, "The database is temporarily unavailable", nil, fmt.Errorf("datasource %s: %w", b.name, errCircuitOpen))
+	queryErr.RetryAfter = retryAfter
+	return queryErr
+}
+
+// record counts the outcome of a request that allow let through. A nil breaker (a replica, or
+// breakers turned off) records nothing.
+func (b *circuitBreaker) record(probe bool, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a caller that went away says nothing about the database
+	if errors.Is(err, context.Canceled) {
+		if probe {
+			b.probing = false
+		}
+		return
+	}
+	failure := circuitFailure(err)
+
+	if probe {
+		b.probing = false
+		if failure {
+			b.trip(err)
+		} else {
+			b.reset()
+			b.setState(CIRCUIT_CLOSED)
+		}
+		return
+	}
+	if b.state != CIRCUIT_CLOSED {
+		// a query that started before the circuit opened
+		return
+	}
+
+	if failure {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+	if b.recorded == len(b.outcomes) {
+		if b.outcomes[b.next] {
+			b.failed--
+		}
+	} else {
+		b.recorded++
+	}
+	b.outcomes[b.next] = failure
+	if failure {
+		b.failed++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+
+	if b.failures > 0 && b.consecutive >= b.failures {
+		b.trip(err)
+	} else if b.errorRate > 0 && b.recorded == len(b.outcomes) && b.failed*100 >= b.errorRate*len(b.outcomes) {
+		b.trip(err)
+	}
+}
+
+// trip must be called with the lock held
+func (b *circuitBreaker) trip(err error) {
+	b.reset()
+	b.openedAt = time.Now()
+	b.logger.Warnf("queryservice store - circuit breaker of datasource %s opened for %v after: %v", b.name, b.openFor, err)
+	b.setState(CIRCUIT_OPEN)
+}
+
+// reset must be called with the lock held
+func (b *circuitBreaker) reset() {
+	b.consecutive = 0
+	b.next, b.recorded, b.failed = 0, 0, 0
+}
+
+// setState must be called with the lock held
+func (b *circuitBreaker) setState(state CircuitState) {
+	if state == CIRCUIT_CLOSED && b.state != CIRCUIT_CLOSED {
+		b.logger.Infof("queryservice store - circuit breaker of datasource %s closed", b.name)
+	}
+	b.state = state
+	b.metrics.SetCircuitState(b.name, int(state))
+}
+
+// currentState is the state as the next query would find it: an open circuit whose time is up is
+// reported half-open even before a query arrives to probe it.
+func (b *circuitBreaker) currentState() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CIRCUIT_OPEN && time.Since(b.openedAt) >= b.openFor {
+		return CIRCUIT_HALF_OPEN
+	}
+	return b.state
+}
+
+// circuitFailure reports whether a query's error counts against the database: it could not be
+// reached, was shutting down or overloaded, broke the connection, or the query ran out of time,
+// whether waiting for a pooled connection or in the database. A database that stops answering
+// shows up as nothing but timeouts, so they count even when it was the request's own deadline.
+// Errors in the query or its parameters and results over a method's limits do not count.
+func circuitFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return false
+	}
+
+	var acquireErr *acquireTimeoutError
+	if errors.As(err, &acquireErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		code := newDatabaseError(err).Code
+		return code == ERROR_UNAVAILABLE || code == ERROR_TIMEOUT
+	}
+
+	// failures to connect, connections lost while the query ran, and timeouts
+	return true
+}
+
+// CircuitHealth is the state of the circuit breaker of one of the store's datasources.
+type CircuitHealth struct {
+	Name  string // "circuit" for the default datasource, orders/circuit for a datasource named orders
+	State CircuitState
+}
+
+// CircuitHealthCheck reports the state of the store's circuit breakers; it is empty when they are
+// turned off.
+func (store *BaseQueryStore) CircuitHealthCheck() []CircuitHealth {
+	var health []CircuitHealth
+	for _, ds := range store.datasources {
+		if ds.primary.breaker != nil {
+			health = append(health, CircuitHealth{Name: ds.poolName("circuit"), State: ds.primary.breaker.currentState()})
+		}
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
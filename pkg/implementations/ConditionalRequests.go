@@ -0,0 +1,107 @@
+package implementations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
+)
+
+type ifNoneMatchKey struct{}
+
+// WithIfNoneMatch returns a context carrying the request's If-None-Match header. Results whose ETag
+// matches it come back from the store as NotModified, and for methods with a version query the
+// query itself is skipped.
+func WithIfNoneMatch(ctx context.Context, ifNoneMatch string) context.Context {
+	if ifNoneMatch == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, ifNoneMatchKey{}, ifNoneMatch)
+}
+
+// IfNoneMatch returns the header set with WithIfNoneMatch, or "" if the request had none.
+func IfNoneMatch(ctx context.Context) string {
+	ifNoneMatch, _ := ctx.Value(ifNoneMatchKey{}).(string)
+	return ifNoneMatch
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. As the RFC requires for
+// If-None-Match the comparison is weak, so a W/ prefix added by a proxy still matches.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func hashETag(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// bodyETag tags results by their content. It saves the bandwidth of an unchanged response, though
+// not the query.
+func bodyETag(body []byte) string {
+	return hashETag(body)
+}
+
+// versionETag runs the method's version query (on every shard, for scatter-gather methods) and tags
+// the results by its value. The query goes through the same path as the method's own query, so it
+// is retried, guarded by the datasource's circuit breaker and run in the session time zone just the
+// same. The request key and the query are part of the hash, so different parameters, identities or
+// time zones never share a tag and a changed query in the queries file invalidates the tags handed
+// out for the old one.
+func (store *BaseQueryStore) versionETag(
+	ctx context.Context,
+	method *models.Method,
+	targets []*storePool,
+	key string,
+	paramMap pgx.NamedArgs,
+	options ReaderOptions) (string, error) {
+
+	ctx, span := Tracer().Start(ctx, "queryservice.version.query")
+	defer span.End()
+
+	// the version is a single value, so the method's result limits do not apply to it
+	options.MaxRows, options.MaxResponseBytes = 0, 0
+
+	parts := [][]byte{[]byte(key), []byte(method.Query)}
+	for _, target := range targets {
+		result, err := store.runQueryWithRetries(ctx, method, target, method.GetVersionQueryStringInCallableFormat(), paramMap, options)
+		if err != nil {
+			RecordSpanError(span, err)
+			return "", err
+		}
+		parts = append(parts, result.Body)
+	}
+
+	return hashETag(parts...), nil
+}
+
+// notModified returns result flagged NotModified when the request's If-None-Match matches its ETag.
+// Results may be shared through the result cache or request coalescing, so result itself is never
+// changed.
+func notModified(ctx context.Context, result *QueryResult) *QueryResult {
+	if !etagMatches(IfNoneMatch(ctx), result.ETag) {
+		return result
+	}
+	return &QueryResult{
+		RowCount:     result.RowCount,
+		ETag:         result.ETag,
+		CacheControl: result.CacheControl,
+		NotModified:  true,
+	}
+}
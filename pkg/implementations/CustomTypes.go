@@ -0,0 +1,151 @@
+package implementations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// datasourceTypes are the types registered on the connections of one datasource (its primary and its
+// replicas): the PostGIS types when enabled, and the user-defined enums, domains and composites listed
+// for it. The default datasource takes them from DB_CUSTOM_TYPES and POSTGIS_ENABLED, and a named one
+// from DATASOURCES.<name>.customtypes and DATASOURCES.<name>.postgis, since each database has its own
+// extensions and types.
+type datasourceTypes struct {
+	customTypesKey  string // the setting the custom types were read from, for error messages
+	customTypeNames []string
+	postGISEnabled  bool
+
+	// domainBaseOIDs maps each registered domain (and nothing else) to its base type. Postgres reports
+	// domain columns with the base type's OID, but arrays and composite fields of a domain carry the
+	// domain's own OID, and the reader needs the base type to pick the right encoding for them. OIDs
+	// are assigned by each database, so the map is kept per datasource.
+	domainBaseOIDs sync.Map
+}
+
+// newDatasourceTypes reads a datasource's type settings from configuration.
+func newDatasourceTypes(configuration *viper.Viper, customTypesKey string, postGISKey string) (*datasourceTypes, error) {
+	customTypeNames, err := getCustomTypeNames(configuration, customTypesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &datasourceTypes{
+		customTypesKey:  customTypesKey,
+		customTypeNames: customTypeNames,
+		postGISEnabled:  configuration.GetBool(postGISKey),
+	}, nil
+}
+
+// afterConnect is the pools' AfterConnect hook: codecs for the builtin types (and their arrays) that
+// pgx does not know about, followed by the PostGIS types (when enabled) and the custom types.
+func (t *datasourceTypes) afterConnect(ctx context.Context, conn *pgx.Conn) error {
+	conn.TypeMap().RegisterTypes(textOnlyTypes())
+	if t.postGISEnabled {
+		if err := registerPostGISTypes(ctx, conn); err != nil {
+			return err
+		}
+	}
+	return t.registerCustomTypes(ctx, conn)
+}
+
+// getCustomTypeNames reads the user-defined types (enums, domains and composites) to register on
+// each pooled connection. The setting is a json array of type names, optionally schema qualified
+// (e.g. ["mood","billing.address"]). Types are not required to be listed in dependency order.
+func getCustomTypeNames(configuration *viper.Viper, key string) ([]string, error) {
+	customTypes := configuration.GetString(key)
+	if customTypes == "" {
+		return nil, nil
+	}
+
+	var typeNames []string
+	if err := json.Unmarshal([]byte(customTypes), &typeNames); err != nil {
+		return nil, fmt.Errorf("queryservice store - unmarshalling of custom types JSON from %s failed with %w", key, err)
+	}
+
+	return typeNames, nil
+}
+
+// arrayTypeName returns the name postgres gives the array type of typeName (_mood, billing._address)
+func arrayTypeName(typeName string) string {
+	if schema, name, found := strings.Cut(typeName, "."); found {
+		return schema + "._" + name
+	}
+	return "_" + typeName
+}
+
+// registerCustomTypes loads the listed types from the database catalog and registers them with the
+// connection's type map. It is called from the pool's AfterConnect hook, so every connection knows
+// the types before it is handed out. The array type of each listed type is registered as well, and
+// pgx pulls in any types a composite depends on.
+func (t *datasourceTypes) registerCustomTypes(ctx context.Context, conn *pgx.Conn) error {
+	if len(t.customTypeNames) == 0 {
+		return nil
+	}
+
+	namesToLoad := make([]string, 0, len(t.customTypeNames)*2)
+	for _, typeName := range t.customTypeNames {
+		namesToLoad = append(namesToLoad, typeName, arrayTypeName(typeName))
+	}
+
+	types, err := conn.LoadTypes(ctx, namesToLoad)
+	if err != nil {
+		return fmt.Errorf("queryservice store - unable to load custom types %v: %w", t.customTypeNames, err)
+	}
+	conn.TypeMap().RegisterTypes(types)
+
+	loadedOIDs := make([]uint32, 0, len(types))
+	for _, loadedType := range types {
+		loadedOIDs = append(loadedOIDs, loadedType.OID)
+	}
+	err = t.loadDomainBaseOIDs(ctx, conn, loadedOIDs)
+	if err != nil {
+		return err
+	}
+
+	// LoadTypes silently skips names that are not in the catalog, so report a misspelled type here
+	// rather than as an unsupported field type on the first query that returns it
+	for _, typeName := range t.customTypeNames {
+		if _, ok := conn.TypeMap().TypeForName(typeName); !ok {
+			return fmt.Errorf("queryservice store - custom type %s listed in %s was not found in the database", typeName, t.customTypesKey)
+		}
+	}
+
+	return nil
+}
+
+func (t *datasourceTypes) loadDomainBaseOIDs(ctx context.Context, conn *pgx.Conn, typeOIDs []uint32) error {
+	rows, err := conn.Query(ctx, "SELECT oid, typbasetype FROM pg_catalog.pg_type WHERE typtype = 'd' AND oid = ANY($1)", typeOIDs)
+	if err != nil {
+		return fmt.Errorf("queryservice store - unable to look up custom domain types: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domainOID, baseOID uint32
+		if err := rows.Scan(&domainOID, &baseOID); err != nil {
+			return fmt.Errorf("queryservice store - unable to read custom domain types: %w", err)
+		}
+		t.domainBaseOIDs.Store(domainOID, baseOID)
+	}
+
+	return rows.Err()
+}
+
+// domainBaseOID returns the base type of a registered domain. It is safe to call on nil (a reader
+// made outside of a store, which knows no domains).
+func (t *datasourceTypes) domainBaseOID(fieldType uint32) (uint32, bool) {
+	if t == nil {
+		return 0, false
+	}
+	baseOID, isDomain := t.domainBaseOIDs.Load(fieldType)
+	if !isDomain {
+		return 0, false
+	}
+	return baseOID.(uint32), true
+}
@@ -0,0 +1,327 @@
+package implementations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+)
+
+const (
+	PRIMARY_POOL = "primary"
+
+	defaultReplicaHealthInterval = 10 * time.Second
+	replicaPingTimeout           = 5 * time.Second
+
+	// how long a canceled query has to stop before its connection is given up on
+	cancelRequestDeadline = 5 * time.Second
+)
+
+// storePool is one of a store's connection pools: the primary, or one of the read replicas listed in
+// DB_REPLICA_CONNECTSTRINGS. Replicas are taken out of rotation while they are unhealthy; primaries
+// are guarded by their datasource's circuit breaker instead.
+type storePool struct {
+	name    string
+	pool    *pgxpool.Pool
+	replica bool
+	healthy atomic.Bool
+	breaker *circuitBreaker // nil for replicas, and when circuit breakers are turned off
+	primary *storePool      // for a replica, the primary of its datasource, which its failed queries are retried on
+	types   *datasourceTypes
+}
+
+// newPoolConfig builds the pgxpool configuration shared by the primary and the replicas.
+func newPoolConfig(connectString string, storeName string, poolName string, afterConnect func(context.Context, *pgx.Conn) error) (*pgxpool.Config, error) {
+	connConfig, err := pgxpool.ParseConfig(connectString)
+	if err != nil {
+		return nil, err
+	}
+
+	connConfig.MaxConnIdleTime = 60 * time.Second
+	connConfig.MaxConnLifetime = 60 * time.Second
+	connConfig.MaxConns = 15
+
+	// child spans for pool acquires and query executions (no-op unless the service installs an otel SDK)
+	connConfig.ConnConfig.Tracer = &poolTracer{store: storeName, pool: poolName}
+
+	// a canceled query (a request that went away, or a truncated read) is canceled on the server, which
+	// keeps the connection usable; pgx's default closes the connection instead
+	connConfig.ConnConfig.BuildContextWatcherHandler = func(conn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.CancelRequestContextWatcherHandler{Conn: conn, DeadlineDelay: cancelRequestDeadline}
+	}
+
+	connConfig.AfterConnect = afterConnect
+
+	return connConfig, nil
+}
+
+// datasource is a database the store runs queries against: its primary pool and any read replicas.
+// The default datasource is DB_CONNECTSTRING (with DB_REPLICA_CONNECTSTRINGS); the named ones are
+// configured under DATASOURCES.<name> and bound to a serviceName in the queries file.
+type datasource struct {
+	name     string // "" for the default datasource
+	primary  *storePool
+	replicas []*storePool
+	nextPool atomic.Uint32
+	types    *datasourceTypes // shared by the primary and the replicas
+}
+
+// poolName returns the name used for one of the datasource's pools in metrics, traces and health
+// output: primary and replica-1 for the default datasource, orders/primary and orders/replica-1 for
+// a datasource named orders.
+func (ds *datasource) poolName(pool string) string {
+	if ds.name == "" {
+		return pool
+	}
+	return ds.name + "/" + pool
+}
+
+// getReplicaConnectStrings reads a replica setting (DB_REPLICA_CONNECTSTRINGS or
+// DATASOURCES.<name>.replicas), which is either a single connection string or a json array of them.
+func getReplicaConnectStrings(configuration *viper.Viper, key string) ([]string, error) {
+	replicas := strings.TrimSpace(configuration.GetString(key))
+	if replicas == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(replicas, "[") {
+		return []string{replicas}, nil
+	}
+
+	var connectStrings []string
+	if err := json.Unmarshal([]byte(replicas), &connectStrings); err != nil {
+		return nil, fmt.Errorf("queryservice store - unmarshalling of replica connection strings JSON from %s failed with %w", key, err)
+	}
+
+	return connectStrings, nil
+}
+
+// getDatasourceKeys returns the settings found for each datasource configured under DATASOURCES,
+// by datasource name. The names come from the flat keys rather than GetStringMap because viper only
+// nests keys set in code; the dotted keys of app.env and the environment stay flat.
+func getDatasourceKeys(configuration *viper.Viper) map[string][]string {
+	prefix := strings.ToLower(constants.DATASOURCES) + "."
+	keys := map[string][]string{}
+	for _, key := range configuration.AllKeys() {
+		rest, found := strings.CutPrefix(key, prefix)
+		if !found {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, ".")
+		if name != "" {
+			keys[name] = append(keys[name], key)
+		}
+	}
+
+	return keys
+}
+
+// connectDatasources opens the pools of every datasource configured under DATASOURCES, whether or
+// not the store's queries use it, so that the health check store reports on all of them.
+func (store *BaseQueryStore) connectDatasources(configuration *viper.Viper) error {
+	for name, found := range getDatasourceKeys(configuration) {
+		key := constants.DATASOURCES + "." + name
+		connectString := configuration.GetString(key + "." + constants.DATASOURCE_CONNECTSTRING)
+		if connectString == "" {
+			sort.Strings(found)
+			return fmt.Errorf("queryservice store - unable to retrieve the connection string of datasource %s from %s.%s (found %s; check the spelling of the setting names)",
+				name, key, constants.DATASOURCE_CONNECTSTRING, strings.Join(found, ", "))
+		}
+
+		types, err := newDatasourceTypes(configuration, key+"."+constants.DATASOURCE_CUSTOM_TYPES, key+"."+constants.DATASOURCE_POSTGIS)
+		if err != nil {
+			return err
+		}
+
+		ds := &datasource{name: name, types: types}
+		connConfig, err := newPoolConfig(connectString, store.name, ds.poolName(PRIMARY_POOL), types.afterConnect)
+		if err != nil {
+			return fmt.Errorf("queryservice store - unable to parse connection config of datasource %s: %v", name, err)
+		}
+		pool, err := pgxpool.NewWithConfig(*store.rootCtx, connConfig)
+		if err != nil {
+			return fmt.Errorf("queryservice store - unable to connect to datasource %s: %v", name, err)
+		}
+		err = pool.Ping(*store.rootCtx)
+		if err != nil {
+			return fmt.Errorf("queryservice store - unable to ping datasource %s: %w", name, err)
+		}
+		store.addPrimary(ds, pool)
+
+		err = store.connectReplicas(configuration, ds, key+"."+constants.DATASOURCE_REPLICAS)
+		if err != nil {
+			return err
+		}
+		store.datasources[name] = ds
+	}
+
+	return nil
+}
+
+func (store *BaseQueryStore) addPrimary(ds *datasource, pool *pgxpool.Pool) {
+	ds.primary = &storePool{name: ds.poolName(PRIMARY_POOL), pool: pool, types: ds.types}
+	ds.primary.healthy.Store(true)
+	store.metrics.AddPool(store.name, ds.primary.name, pool)
+}
+
+// connectReplicas opens a pool for each of a datasource's read replicas. A replica that cannot be
+// reached at startup does not stop the store from starting; it stays out of rotation until the
+// health monitor reaches it.
+func (store *BaseQueryStore) connectReplicas(configuration *viper.Viper, ds *datasource, key string) error {
+	connectStrings, err := getReplicaConnectStrings(configuration, key)
+	if err != nil {
+		return err
+	}
+
+	for i, connectString := range connectStrings {
+		replica := &storePool{name: ds.poolName(fmt.Sprintf("replica-%d", i+1)), replica: true, primary: ds.primary, types: ds.types}
+
+		connConfig, err := newPoolConfig(connectString, store.name, replica.name, ds.types.afterConnect)
+		if err != nil {
+			return fmt.Errorf("queryservice store - unable to parse connection config of %s: %v", replica.name, err)
+		}
+		replica.pool, err = pgxpool.NewWithConfig(*store.rootCtx, connConfig)
+		if err != nil {
+			return fmt.Errorf("queryservice store - unable to connect to %s: %v", replica.name, err)
+		}
+
+		ds.replicas = append(ds.replicas, replica)
+		store.metrics.AddPool(store.name, replica.name, replica.pool)
+		if err := store.pingReplica(replica); err != nil {
+			store.logger.Warnf("queryservice store - %s of the %s store is unreachable and starts out of rotation: %v", replica.name, store.name, err)
+		}
+	}
+
+	return nil
+}
+
+// startReplicaMonitor starts the replica health monitor when any datasource has replicas.
+func (store *BaseQueryStore) startReplicaMonitor(configuration *viper.Viper) {
+	var replicas []*storePool
+	for _, ds := range store.datasources {
+		replicas = append(replicas, ds.replicas...)
+	}
+	if len(replicas) == 0 {
+		return
+	}
+
+	interval := defaultReplicaHealthInterval
+	if seconds := configuration.GetInt(constants.DB_REPLICA_HEALTH_INTERVAL_SECONDS); seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+	go store.monitorReplicas(replicas, interval)
+}
+
+// poolFor picks the pool of the datasource that a method's query runs on. Replicas are used round
+// robin, and methods that ask for a replica fail over to the primary when no replica is healthy.
+func (ds *datasource) poolFor(method *models.Method) *storePool {
+	if method.Consistency == models.CONSISTENCY_PRIMARY || len(ds.replicas) == 0 {
+		return ds.primary
+	}
+
+	candidates := make([]*storePool, 0, len(ds.replicas)+1)
+	for _, replica := range ds.replicas {
+		if replica.healthy.Load() {
+			candidates = append(candidates, replica)
+		}
+	}
+	if method.Consistency == models.CONSISTENCY_ANY || len(candidates) == 0 {
+		candidates = append(candidates, ds.primary)
+	}
+
+	return candidates[int(ds.nextPool.Add(1)%uint32(len(candidates)))]
+}
+
+// poolNames lists the pools a request runs on, for its trace span
+func poolNames(targets []*storePool) string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// monitorReplicas pings the replicas until the store's root context is canceled, so that a replica
+// that went away is taken out of rotation and one that came back is returned to it.
+func (store *BaseQueryStore) monitorReplicas(replicas []*storePool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-(*store.rootCtx).Done():
+			return
+		case <-ticker.C:
+			for _, replica := range replicas {
+				store.pingReplica(replica)
+			}
+		}
+	}
+}
+func (store *BaseQueryStore) pingReplica(replica *storePool) error {
+	ctx, cancel := context.WithTimeout(*store.rootCtx, replicaPingTimeout)
+	defer cancel()
+
+	err := replica.pool.Ping(ctx)
+	store.setReplicaHealth(replica, err)
+	return err
+}
+
+// setReplicaHealth records the outcome of talking to a replica, logging when it changes.
+func (store *BaseQueryStore) setReplicaHealth(replica *storePool, err error) {
+	healthy := err == nil
+	if replica.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		store.logger.Infof("queryservice store - %s of the %s store is healthy and back in rotation", replica.name, store.name)
+	} else {
+		store.logger.Warnf("queryservice store - %s of the %s store is unhealthy and out of rotation: %v", replica.name, store.name, err)
+	}
+}
+
+// newPoolError converts a database error into a QueryError like newDatabaseError does. When the error
+// shows that a replica is unavailable, the replica is taken out of rotation right away rather than
+// at the next health check. A pool that is merely exhausted stays in rotation.
+func (store *BaseQueryStore) newPoolError(target *storePool, err error) *QueryError {
+	queryErr := newDatabaseError(err)
+	var acquireErr *acquireTimeoutError
+	if target.replica && queryErr.Code == ERROR_UNAVAILABLE && !errors.As(err, &acquireErr) {
+		store.setReplicaHealth(target, err)
+	}
+	return queryErr
+}
+
+// PoolHealth is the outcome of pinging one of the store's pools.
+type PoolHealth struct {
+	Name    string
+	Replica bool
+	Err     error // nil when healthy
+}
+
+// PoolHealthCheck pings the pools of the named datasources and every read replica; the default
+// datasource's primary is covered by HealthCheck.
+func (store *BaseQueryStore) PoolHealthCheck() []PoolHealth {
+	var health []PoolHealth
+	for _, ds := range store.datasources {
+		if ds.name != "" {
+			health = append(health, PoolHealth{Name: ds.primary.name, Err: ds.primary.pool.Ping(*store.rootCtx)})
+		}
+		for _, replica := range ds.replicas {
+			health = append(health, PoolHealth{Name: replica.name, Replica: true, Err: store.pingReplica(replica)})
+		}
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
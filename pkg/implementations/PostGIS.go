@@ -0,0 +1,87 @@
+package implementations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/twpayne/go-geom/encoding/ewkb"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+// wgs84SRID is the only coordinate system GeoJSON allows
+const wgs84SRID = 4326
+
+// geometryCodec reads PostGIS geometry and geography values in their binary (EWKB) form. It only
+// exists so the reader can tell them apart from real bytea values; decoding is left to ByteaCodec.
+type geometryCodec struct {
+	pgtype.ByteaCodec
+}
+
+// registerPostGISTypes registers the PostGIS geometry and geography types (and their arrays) with
+// the connection's type map. Their OIDs are assigned when the extension is created, so they are
+// looked up in the catalog rather than hard coded. It runs before the custom types are loaded so
+// that composites with geometry fields can be registered.
+func registerPostGISTypes(ctx context.Context, conn *pgx.Conn) error {
+	rows, err := conn.Query(ctx, "SELECT typname, oid, typarray FROM pg_catalog.pg_type WHERE typname IN ('geometry', 'geography')")
+	if err != nil {
+		return fmt.Errorf("queryservice store - unable to look up PostGIS types: %w", err)
+	}
+	defer rows.Close()
+
+	registered := 0
+	for rows.Next() {
+		var typeName string
+		var typeOID, arrayOID uint32
+		if err := rows.Scan(&typeName, &typeOID, &arrayOID); err != nil {
+			return fmt.Errorf("queryservice store - unable to read PostGIS types: %w", err)
+		}
+
+		geometryType := &pgtype.Type{Name: typeName, OID: typeOID, Codec: geometryCodec{}}
+		conn.TypeMap().RegisterType(geometryType)
+		conn.TypeMap().RegisterType(&pgtype.Type{Name: "_" + typeName, OID: arrayOID, Codec: &pgtype.ArrayCodec{ElementType: geometryType}})
+		registered++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("queryservice store - unable to read PostGIS types: %w", err)
+	}
+
+	if registered == 0 {
+		return fmt.Errorf("queryservice store - POSTGIS_ENABLED is set but the postgis extension is not installed in the database")
+	}
+
+	return nil
+}
+
+// geoJSONValue writes a geometry or geography value as a GeoJSON geometry object
+// ({"type": "Polygon", "coordinates": [...]}). GeoJSON coordinates are WGS 84 (SRID 4326), so values
+// in that SRID, or with none, are written as is. Any other SRID is kept in a "crs" member naming it
+// ({"type": "name", "properties": {"name": "EPSG:3857"}}), the way ST_AsGeoJSON does, rather than
+// being dropped; transform in the query (ST_Transform(geom, 4326)) to get plain GeoJSON instead.
+func geoJSONValue(value interface{}) (interface{}, error) {
+	wkb, ok := value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("queryservice store - invalid geometry value %v detected", value)
+	}
+
+	geometry, err := ewkb.Unmarshal(wkb)
+	if err != nil {
+		return nil, fmt.Errorf("queryservice store - unable to decode stored geometry value: %v", err)
+	}
+
+	var options []geojson.EncodeGeometryOption
+	if srid := geometry.SRID(); srid != 0 && srid != wgs84SRID {
+		options = append(options, geojson.EncodeGeometryWithCRS(&geojson.CRS{
+			Type:       "name",
+			Properties: map[string]interface{}{"name": fmt.Sprintf("EPSG:%d", srid)},
+		}))
+	}
+
+	geoJSON, err := geojson.Encode(geometry, options...)
+	if err != nil {
+		return nil, fmt.Errorf("queryservice store - unable to convert stored geometry value to GeoJSON: %v", err)
+	}
+
+	return geoJSON, nil
+}
@@ -0,0 +1,93 @@
+package implementations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+)
+
+// SQLSTATE codes and classes that get special treatment. See
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	SQLSTATE_CLASS_DATA_EXCEPTION          = "22"
+	SQLSTATE_CLASS_CONNECTION_EXCEPTION    = "08"
+	SQLSTATE_CLASS_INSUFFICIENT_RESOURCES  = "53"
+	SQLSTATE_QUERY_CANCELED                = "57014"
+	SQLSTATE_UNDEFINED_FUNCTION            = "42883"
+	SQLSTATE_ADMIN_SHUTDOWN                = "57P01"
+	SQLSTATE_CRASH_SHUTDOWN                = "57P02"
+	SQLSTATE_CANNOT_CONNECT_NOW            = "57P03"
+	SQLSTATE_SERIALIZATION_FAILURE         = "40001"
+	LOG_MARKER_UNDEFINED_DATABASE_FUNCTION = "UNDEFINED_DATABASE_FUNCTION"
+)
+
+// newDatabaseError converts an error returned by pgx into a QueryError with a caller-safe message.
+// Only the SQLSTATE is passed back to the caller; the message, detail and hint stay in the logs.
+func newDatabaseError(err error) *QueryError {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		code := pgErr.Code
+		switch {
+		case strings.HasPrefix(code, SQLSTATE_CLASS_DATA_EXCEPTION):
+			return NewQueryError(ERROR_INVALID_PARAMS,
+				fmt.Sprintf("The database rejected one or more parameter values (SQLSTATE %s)", code), nil, err)
+		case code == SQLSTATE_QUERY_CANCELED:
+			return NewQueryError(ERROR_TIMEOUT,
+				fmt.Sprintf("The query was canceled by the database before it completed (SQLSTATE %s)", code), nil, err)
+		case strings.HasPrefix(code, SQLSTATE_CLASS_CONNECTION_EXCEPTION),
+			strings.HasPrefix(code, SQLSTATE_CLASS_INSUFFICIENT_RESOURCES),
+			code == SQLSTATE_ADMIN_SHUTDOWN, code == SQLSTATE_CRASH_SHUTDOWN, code == SQLSTATE_CANNOT_CONNECT_NOW:
+			return NewQueryError(ERROR_UNAVAILABLE,
+				fmt.Sprintf("The database is temporarily unavailable (SQLSTATE %s)", code), nil, err)
+		default:
+			return NewQueryError(ERROR_BACKEND, backendErrorMessage, nil, err)
+		}
+	}
+
+	// the pool stayed exhausted for longer than DB_ACQUIRE_TIMEOUT_MS
+	var acquireErr *acquireTimeoutError
+	if errors.As(err, &acquireErr) {
+		return NewQueryError(ERROR_UNAVAILABLE, "The database is temporarily unavailable", nil, err)
+	}
+
+	// failures to open a connection never reach the server, so there is no SQLSTATE to inspect
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return NewQueryError(ERROR_UNAVAILABLE, "The database is temporarily unavailable", nil, err)
+	}
+
+	return newBackendError(err)
+}
+
+// logDatabaseError writes the full postgres error (SQLSTATE, detail, hint, position) to the log.
+func logDatabaseError(logger *logrus.Logger, caller string, err error) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		logger.Errorf("queryservice store - error detected while calling %s: %v", caller, err)
+		return
+	}
+
+	fields := logrus.Fields{
+		"sqlstate":   pgErr.Code,
+		"severity":   pgErr.Severity,
+		"detail":     pgErr.Detail,
+		"hint":       pgErr.Hint,
+		"position":   pgErr.Position,
+		"where":      pgErr.Where,
+		"schema":     pgErr.SchemaName,
+		"table":      pgErr.TableName,
+		"column":     pgErr.ColumnName,
+		"constraint": pgErr.ConstraintName,
+		"routine":    pgErr.Routine,
+	}
+	if pgErr.Code == SQLSTATE_UNDEFINED_FUNCTION {
+		// usually a query file referencing a stored function that was never deployed to this database
+		fields["marker"] = LOG_MARKER_UNDEFINED_DATABASE_FUNCTION
+	}
+
+	logger.WithFields(fields).Errorf(constants.NPG_EXCEPTION_MESSAGE, caller, pgErr.Message)
+}
@@ -0,0 +1,102 @@
+package implementations
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+)
+
+// ErrorCode is the stable, machine readable code returned to callers in the error envelope.
+// Clients should branch on these rather than on the message text, which may change.
+type ErrorCode string
+
+const (
+	ERROR_NOT_FOUND      ErrorCode = "NOT_FOUND"
+	ERROR_MISSING_PARAMS ErrorCode = "MISSING_PARAMS"
+	ERROR_INVALID_PARAMS ErrorCode = "INVALID_PARAMS"
+	ERROR_TIMEOUT        ErrorCode = "TIMEOUT"
+	ERROR_BACKEND        ErrorCode = "BACKEND_ERROR"
+	ERROR_UNAVAILABLE    ErrorCode = "UNAVAILABLE"
+	ERROR_UNAUTHORIZED   ErrorCode = "UNAUTHORIZED"
+	ERROR_TOO_LARGE      ErrorCode = "RESULT_TOO_LARGE"
+	ERROR_RATE_LIMITED   ErrorCode = "RATE_LIMITED"
+)
+
+// QueryError is the error type returned by the query store. Message is safe to return to the
+// caller; the underlying cause (which may hold database details) is only available via Unwrap
+// for logging.
+type QueryError struct {
+	Code    ErrorCode
+	Message string
+	Params  []string
+	cause   error
+
+	RetryAfter time.Duration // sent as Retry-After when set, e.g. while a circuit breaker is open or a rate limit is exceeded
+
+	pool *storePool // the pool the query failed on, when it got that far
+}
+
+// NewQueryError builds a QueryError. params lists the offending parameter names (if any) and
+// cause is the internal error being wrapped (may be nil).
+func NewQueryError(code ErrorCode, message string, params []string, cause error) *QueryError {
+	return &QueryError{Code: code, Message: message, Params: params, cause: cause}
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.cause
+}
+
+// HttpStatus returns the http status the routers use for this error.
+func (e *QueryError) HttpStatus() int {
+	switch e.Code {
+	case ERROR_NOT_FOUND:
+		return http.StatusNotFound
+	case ERROR_MISSING_PARAMS, ERROR_INVALID_PARAMS:
+		return http.StatusBadRequest
+	case ERROR_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case ERROR_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case ERROR_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	case ERROR_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case ERROR_RATE_LIMITED:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// AsQueryError returns err as a QueryError. Errors that did not come from the store are treated as
+// backend errors so that their text is never returned to the caller.
+func AsQueryError(err error) *QueryError {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return queryErr
+	}
+	return newBackendError(err)
+}
+
+// newBackendError hides the database error from the caller behind a generic message.
+func newBackendError(cause error) *QueryError {
+	if errors.Is(cause, context.DeadlineExceeded) || errors.Is(cause, context.Canceled) {
+		return NewQueryError(ERROR_TIMEOUT, "The query was canceled or timed out before it completed", nil, cause)
+	}
+	return NewQueryError(ERROR_BACKEND, backendErrorMessage, nil, cause)
+}
+
+const backendErrorMessage = constants.INTERNAL_SERVER_ERROR + "A backend system error occurred in the queries service. Please check the logs"
+
+// errorClass is the label used for the errors_total metric
+func errorClass(err error) string {
+	return strings.ToLower(string(AsQueryError(err).Code))
+}
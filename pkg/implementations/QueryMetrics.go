@@ -0,0 +1,284 @@
+package implementations
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "siftd_queryservice"
+
+	// method label used for requests that do not match a defined service/method. This keeps
+	// callers from inflating the label cardinality by calling random urls.
+	undefinedMethodLabel = "undefined"
+)
+
+// QueryMetrics holds the prometheus collectors shared by every query store in the process.
+// The public, secured and healthcheck stores each have their own pool, so the store name is
+// carried as a label rather than registering a separate set of collectors per store.
+type QueryMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	rows     *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	pools    *poolStatsCollector
+
+	cacheLookups   *prometheus.CounterVec
+	cacheEvictions *prometheus.CounterVec
+	cacheEntries   *prometheus.GaugeVec
+	cacheBytes     *prometheus.GaugeVec
+
+	coalesced *prometheus.CounterVec
+	retries   *prometheus.CounterVec
+	circuits  *prometheus.GaugeVec
+
+	rateLimited *prometheus.CounterVec
+}
+
+var (
+	queryMetrics     *QueryMetrics
+	queryMetricsOnce sync.Once
+)
+
+// GetQueryMetrics returns the process-wide QueryMetrics, registering the collectors with the
+// default prometheus registerer on first use.
+func GetQueryMetrics() *QueryMetrics {
+	queryMetricsOnce.Do(func() {
+		queryMetrics = newQueryMetrics(prometheus.DefaultRegisterer)
+	})
+	return queryMetrics
+}
+
+func newQueryMetrics(registerer prometheus.Registerer) *QueryMetrics {
+	m := &QueryMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Number of query requests handled, by store, service, method and outcome.",
+		}, []string{"store", "service", "method", "outcome"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time spent running a query request, including parameter handling and result encoding.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"store", "service", "method"}),
+		rows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "result_rows",
+			Help:      "Number of rows returned by successful query requests.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"store", "service", "method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "errors_total",
+			Help:      "Number of failed query requests, by error code.",
+		}, []string{"store", "service", "method", "class"}),
+		pools: newPoolStatsCollector(),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "lookups_total",
+			Help:      "Result cache lookups for methods with a cacheTtlSeconds, by result (hit or miss).",
+		}, []string{"store", "service", "method", "result"}),
+		cacheEvictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "evictions_total",
+			Help:      "Result cache entries removed, by reason (expired or capacity).",
+		}, []string{"store", "reason"}),
+		cacheEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "entries",
+			Help:      "Entries currently held in the result cache.",
+		}, []string{"store"}),
+		cacheBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cache",
+			Name:      "bytes",
+			Help:      "Size of the json results currently held in the result cache.",
+		}, []string{"store"}),
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "coalesced_requests_total",
+			Help:      "Query requests that shared a single execution with identical concurrent requests.",
+		}, []string{"store", "service", "method"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "query_retries_total",
+			Help:      "Queries run again after a transient connection-level database failure.",
+		}, []string{"store", "service", "method"}),
+		circuits: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "State of each datasource's circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, []string{"datasource"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Query requests rejected with 429, by the rate limit exceeded (caller, method or method_caller).",
+		}, []string{"store", "service", "method", "scope"}),
+	}
+
+	registerer.MustRegister(m.requests, m.duration, m.rows, m.errors, m.pools,
+		m.cacheLookups, m.cacheEvictions, m.cacheEntries, m.cacheBytes, m.coalesced, m.retries, m.circuits, m.rateLimited)
+
+	return m
+}
+
+// ObserveRequest records the outcome of a single query request. Failures are counted by the
+// lower-cased QueryError code (e.g. missing_params, backend_error).
+func (m *QueryMetrics) ObserveRequest(store string, service string, method string, elapsed time.Duration, rowCount int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+		m.errors.WithLabelValues(store, service, method, errorClass(err)).Inc()
+	} else {
+		m.rows.WithLabelValues(store, service, method).Observe(float64(rowCount))
+	}
+
+	m.requests.WithLabelValues(store, service, method, outcome).Inc()
+	m.duration.WithLabelValues(store, service, method).Observe(elapsed.Seconds())
+}
+
+// ObserveCacheLookup counts a result cache hit or miss.
+func (m *QueryMetrics) ObserveCacheLookup(store string, service string, method string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(store, service, method, result).Inc()
+}
+
+// ObserveCacheEviction counts an entry removed from the result cache.
+func (m *QueryMetrics) ObserveCacheEviction(store string, reason string) {
+	m.cacheEvictions.WithLabelValues(store, reason).Inc()
+}
+
+// SetCacheSize records the current size of a store's result cache.
+func (m *QueryMetrics) SetCacheSize(store string, entries int, bytes int) {
+	m.cacheEntries.WithLabelValues(store).Set(float64(entries))
+	m.cacheBytes.WithLabelValues(store).Set(float64(bytes))
+}
+
+// ObserveCoalescedRequest counts a request that shared its query execution with other requests.
+func (m *QueryMetrics) ObserveCoalescedRequest(store string, service string, method string) {
+	m.coalesced.WithLabelValues(store, service, method).Inc()
+}
+
+// SetCircuitState records the state of a datasource's circuit breaker.
+func (m *QueryMetrics) SetCircuitState(datasource string, state int) {
+	m.circuits.WithLabelValues(datasource).Set(float64(state))
+}
+
+// ObserveRateLimited counts a request rejected by one of its rate limits.
+func (m *QueryMetrics) ObserveRateLimited(store string, service string, method string, scope string) {
+	m.rateLimited.WithLabelValues(store, service, method, scope).Inc()
+}
+
+// ObserveRetry counts a query that is run again after a transient failure.
+func (m *QueryMetrics) ObserveRetry(store string, service string, method string) {
+	m.retries.WithLabelValues(store, service, method).Inc()
+}
+
+// AddPool makes the stats of one of a store's pools (the primary or a replica) visible on the metrics endpoint.
+func (m *QueryMetrics) AddPool(store string, poolName string, pool *pgxpool.Pool) {
+	m.pools.add(poolKey{store: store, pool: poolName}, pool)
+}
+
+type poolKey struct {
+	store string
+	pool  string
+}
+
+// poolStatsCollector reads pgxpool.Stat() at scrape time for every registered pool.
+type poolStatsCollector struct {
+	mu    sync.RWMutex
+	pools map[poolKey]*pgxpool.Pool
+
+	acquiredConns     *prometheus.Desc
+	idleConns         *prometheus.Desc
+	totalConns        *prometheus.Desc
+	maxConns          *prometheus.Desc
+	acquireCount      *prometheus.Desc
+	acquireWait       *prometheus.Desc
+	emptyAcquireCount *prometheus.Desc
+	emptyAcquireWait  *prometheus.Desc
+	canceledAcquires  *prometheus.Desc
+	newConnsCount     *prometheus.Desc
+	lifetimeDestroyed *prometheus.Desc
+	idleTimeDestroyed *prometheus.Desc
+	constructingConns *prometheus.Desc
+}
+
+func newPoolStatsCollector() *poolStatsCollector {
+	labels := []string{"store", "pool"}
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "pool", name), help, labels, nil)
+	}
+
+	return &poolStatsCollector{
+		pools:             make(map[poolKey]*pgxpool.Pool),
+		acquiredConns:     desc("acquired_connections", "Connections currently acquired from the pool."),
+		idleConns:         desc("idle_connections", "Idle connections in the pool."),
+		totalConns:        desc("total_connections", "Total connections in the pool (acquired, idle and constructing)."),
+		maxConns:          desc("max_connections", "Maximum size of the pool."),
+		acquireCount:      desc("acquires_total", "Successful acquires from the pool."),
+		acquireWait:       desc("acquire_wait_seconds_total", "Total time spent acquiring connections from the pool."),
+		emptyAcquireCount: desc("empty_acquires_total", "Acquires that had to wait for a connection because the pool was empty."),
+		emptyAcquireWait:  desc("empty_acquire_wait_seconds_total", "Total time spent waiting on an empty pool."),
+		canceledAcquires:  desc("canceled_acquires_total", "Acquires canceled by their context before a connection was available."),
+		newConnsCount:     desc("new_connections_total", "New connections opened by the pool."),
+		lifetimeDestroyed: desc("max_lifetime_destroys_total", "Connections closed because they reached MaxConnLifetime."),
+		idleTimeDestroyed: desc("max_idle_destroys_total", "Connections closed because they reached MaxConnIdleTime."),
+		constructingConns: desc("constructing_connections", "Connections currently being constructed."),
+	}
+}
+
+func (c *poolStatsCollector) add(key poolKey, pool *pgxpool.Pool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pools[key] = pool
+}
+
+func (c *poolStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.acquireWait
+	ch <- c.emptyAcquireCount
+	ch <- c.emptyAcquireWait
+	ch <- c.canceledAcquires
+	ch <- c.newConnsCount
+	ch <- c.lifetimeDestroyed
+	ch <- c.idleTimeDestroyed
+	ch <- c.constructingConns
+}
+
+func (c *poolStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for key, pool := range c.pools {
+		stats := pool.Stat()
+
+		ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stats.AcquiredConns()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stats.MaxConns()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stats.AcquireCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.acquireWait, prometheus.CounterValue, stats.AcquireDuration().Seconds(), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stats.EmptyAcquireCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.emptyAcquireWait, prometheus.CounterValue, stats.EmptyAcquireWaitTime().Seconds(), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.canceledAcquires, prometheus.CounterValue, float64(stats.CanceledAcquireCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.newConnsCount, prometheus.CounterValue, float64(stats.NewConnsCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.lifetimeDestroyed, prometheus.CounterValue, float64(stats.MaxLifetimeDestroyCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.idleTimeDestroyed, prometheus.CounterValue, float64(stats.MaxIdleDestroyCount()), key.store, key.pool)
+		ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stats.ConstructingConns()), key.store, key.pool)
+	}
+}
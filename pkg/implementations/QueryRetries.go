@@ -0,0 +1,280 @@
+package implementations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoff     = 50 * time.Millisecond
+	defaultRetryMaxBackoff  = time.Second
+
+	// used when circuit breakers are on and DB_ACQUIRE_TIMEOUT_MS is not set
+	defaultAcquireTimeout = 10 * time.Second
+)
+
+// RetryPolicy controls how queries that fail with a transient connection-level error are retried:
+// up to DB_RETRY_MAX_ATTEMPTS attempts in all (1 turns retries off), waiting DB_RETRY_BACKOFF_MS
+// before the first retry and twice as long before each one after that, up to DB_RETRY_MAX_BACKOFF_MS.
+// Each wait is jittered so that the requests failed by a database failover do not all come back at
+// the same moment.
+type RetryPolicy struct {
+	MaxAttempts    int
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+	AcquireTimeout time.Duration // 0 waits for a pooled connection for as long as the request allows; never 0 with circuit breakers on
+}
+
+// NewRetryPolicy reads the retry settings from configuration. While circuit breakers are on, waiting
+// for a pooled connection has to time out, or queries queuing on an exhausted pool would never count
+// against the breaker; DB_ACQUIRE_TIMEOUT_MS then defaults to 10 seconds and may not be 0.
+func NewRetryPolicy(configuration *viper.Viper) (RetryPolicy, error) {
+	policy := RetryPolicy{
+		MaxAttempts: defaultRetryMaxAttempts,
+		Backoff:     defaultRetryBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+	}
+
+	if configuration.IsSet(constants.DB_RETRY_MAX_ATTEMPTS) {
+		policy.MaxAttempts = configuration.GetInt(constants.DB_RETRY_MAX_ATTEMPTS)
+		if policy.MaxAttempts < 1 {
+			return policy, fmt.Errorf("queryservice store - %s must be at least 1 (no retries), got %d", constants.DB_RETRY_MAX_ATTEMPTS, policy.MaxAttempts)
+		}
+	}
+	if milliseconds := configuration.GetInt(constants.DB_RETRY_BACKOFF_MS); milliseconds > 0 {
+		policy.Backoff = time.Duration(milliseconds) * time.Millisecond
+	}
+	if milliseconds := configuration.GetInt(constants.DB_RETRY_MAX_BACKOFF_MS); milliseconds > 0 {
+		policy.MaxBackoff = time.Duration(milliseconds) * time.Millisecond
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = policy.Backoff
+	}
+	breakers := circuitBreakersEnabled(configuration)
+	if configuration.IsSet(constants.DB_ACQUIRE_TIMEOUT_MS) {
+		milliseconds := configuration.GetInt(constants.DB_ACQUIRE_TIMEOUT_MS)
+		if milliseconds < 0 {
+			return policy, fmt.Errorf("queryservice store - %s may not be negative, got %d", constants.DB_ACQUIRE_TIMEOUT_MS, milliseconds)
+		}
+		if milliseconds == 0 && breakers {
+			return policy, fmt.Errorf("queryservice store - %s may not be 0 while circuit breakers are on", constants.DB_ACQUIRE_TIMEOUT_MS)
+		}
+		policy.AcquireTimeout = time.Duration(milliseconds) * time.Millisecond
+	} else if breakers {
+		policy.AcquireTimeout = defaultAcquireTimeout
+	}
+
+	return policy, nil
+}
+
+// delay returns the wait before the given retry (1 for the first): the backoff for that retry, of
+// which the second half is random.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.MaxBackoff)
+
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// acquireTimeoutError is returned when no pooled connection became free within DB_ACQUIRE_TIMEOUT_MS.
+type acquireTimeoutError struct {
+	pool string
+	err  error
+}
+
+func (e *acquireTimeoutError) Error() string {
+	return fmt.Sprintf("timed out acquiring a connection from the %s pool: %v", e.pool, e.err)
+}
+
+func (e *acquireTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// rowsReadError marks a failure that happened after the first result row was read. Such failures
+// are never retried, even when the error itself is transient.
+type rowsReadError struct {
+	err error
+}
+
+func (e *rowsReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rowsReadError) Unwrap() error {
+	return e.err
+}
+
+// trackedRows records whether any row was read, which decides whether a failure may be retried.
+type trackedRows struct {
+	pgx.Rows
+	read bool
+}
+
+func (r *trackedRows) Next() bool {
+	if r.Rows.Next() {
+		r.read = true
+		return true
+	}
+	return false
+}
+
+// afterRead wraps err in a rowsReadError when rows were read before it happened.
+func (r *trackedRows) afterRead(err error) error {
+	if err == nil || !r.read {
+		return err
+	}
+	return &rowsReadError{err: err}
+}
+
+// acquire takes a connection from pool, waiting at most DB_ACQUIRE_TIMEOUT_MS when it is set.
+func (store *BaseQueryStore) acquire(ctx context.Context, target *storePool) (*pgxpool.Conn, error) {
+	if store.retries.AcquireTimeout <= 0 {
+		return target.pool.Acquire(ctx)
+	}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, store.retries.AcquireTimeout)
+	defer cancel()
+
+	conn, err := target.pool.Acquire(acquireCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+		return nil, &acquireTimeoutError{pool: target.name, err: err}
+	}
+	return conn, err
+}
+
+// retryable reports whether a failed query may be run again: the failure happened before any row was
+// read, and it was a connection-level failure or an exhausted pool. Serialization failures are
+// retried only for read-only methods, since a retry would repeat any side effects.
+func retryable(method *models.Method, err error) bool {
+	var readErr *rowsReadError
+	if errors.As(err, &readErr) {
+		return false
+	}
+
+	var acquireErr *acquireTimeoutError
+	if errors.As(err, &acquireErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == SQLSTATE_SERIALIZATION_FAILURE {
+		return method.ReadOnly
+	}
+
+	return connectionFailure(err)
+}
+
+// connectionFailure reports whether err shows that the database could not be talked to: SQLSTATE
+// class 08, a server shutting down for a failover, a failure to connect or to send the query.
+func connectionFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		code := pgErr.Code
+		return strings.HasPrefix(code, SQLSTATE_CLASS_CONNECTION_EXCEPTION) ||
+			code == SQLSTATE_ADMIN_SHUTDOWN || code == SQLSTATE_CANNOT_CONNECT_NOW
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	// pgx knows when an error happened before anything was sent to the server
+	return pgconn.SafeToRetry(err)
+}
+
+// runQueryWithRetries runs the query on target, retrying transient failures as the store's
+// RetryPolicy allows. A replica that fails with a connection error is taken out of rotation and the
+// retries go to the primary of its datasource instead. It gives up early when the request's context
+// is done. Failures are returned as QueryErrors that are safe to pass on to the caller. The result
+// or error records the pool the last attempt ran on (see ranOn).
+//
+// The circuit breaker of the primary is asked once, before the request's first attempt on it, and
+// told the outcome of the request as a whole, so a request that needed retries counts once.
+func (store *BaseQueryStore) runQueryWithRetries(
+	ctx context.Context,
+	method *models.Method,
+	target *storePool,
+	query string,
+	paramMap pgx.NamedArgs,
+	options ReaderOptions) (*QueryResult, error) {
+
+	var breaker *circuitBreaker
+	var probe bool
+	for attempt := 1; ; attempt++ {
+		if breaker == nil && target.breaker != nil {
+			var err error
+			if probe, err = target.breaker.allow(); err != nil {
+				return nil, err
+			}
+			breaker = target.breaker
+		}
+
+		result, err := store.runQuery(ctx, target, query, paramMap, options)
+		if err == nil {
+			breaker.record(probe, nil)
+			result.pool = target
+			return result, nil
+		}
+		if attempt >= store.retries.MaxAttempts || ctx.Err() != nil || !retryable(method, err) {
+			breaker.record(probe, err)
+			queryErr := store.toQueryError(method, target, err)
+			queryErr.pool = target
+			return nil, queryErr
+		}
+
+		failed := target
+		if target.replica && connectionFailure(err) {
+			store.setReplicaHealth(target, err)
+			target = target.primary
+		}
+
+		delay := store.retries.delay(attempt)
+		store.logger.Warnf("queryservice store - attempt %d of %s/%s on %s failed, retrying on %s in %v: %v",
+			attempt, method.ServiceName, method.MethodName, failed.name, target.name, delay, err)
+		store.metrics.ObserveRetry(store.name, method.ServiceName, method.MethodName)
+		trace.SpanFromContext(ctx).AddEvent("queryservice.retry",
+			trace.WithAttributes(attribute.Int("attempt", attempt), ATTR_DB_POOL.String(target.name)))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			breaker.record(probe, err)
+			queryErr := store.toQueryError(method, failed, err)
+			queryErr.pool = failed
+			return nil, queryErr
+		}
+	}
+}
+
+// ranOn returns the pool that the last attempt of a query run by runQueryWithRetries on target ran
+// on, which is the primary rather than target when a replica failed over to it.
+func ranOn(target *storePool, result *QueryResult, err error) *storePool {
+	var queryErr *QueryError
+	switch {
+	case result != nil && result.pool != nil:
+		return result.pool
+	case errors.As(err, &queryErr) && queryErr.pool != nil:
+		return queryErr.pool
+	}
+	return target
+}
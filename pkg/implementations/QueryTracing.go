@@ -0,0 +1,88 @@
+package implementations
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TRACER_NAME is the instrumentation name used for every span created by the query service.
+// Spans go to the global TracerProvider, so tracing stays a no-op until the service installs an
+// OpenTelemetry SDK provider (otel.SetTracerProvider) in its main package.
+const TRACER_NAME = "github.com/geraldhinson/siftd-queryservice-base"
+
+// span attribute keys shared by the routers and the store
+const (
+	ATTR_QUERY_STORE   = attribute.Key("siftd.query.store")
+	ATTR_QUERY_SERVICE = attribute.Key("siftd.query.service")
+	ATTR_QUERY_METHOD  = attribute.Key("siftd.query.method")
+	ATTR_IDENTITY_ID   = attribute.Key("siftd.identity.id")
+	ATTR_RESULT_ROWS   = attribute.Key("siftd.query.rows")
+	ATTR_CACHE_HIT     = attribute.Key("siftd.cache.hit")
+	ATTR_COALESCED     = attribute.Key("siftd.query.coalesced")
+	ATTR_DB_POOL       = attribute.Key("siftd.db.pool")
+)
+
+// Tracer returns the tracer used for query service spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// RecordSpanError marks the span as failed with the given error.
+func RecordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// poolTracer creates child spans for pool acquires and query executions. It is installed as
+// the pgx ConnConfig.Tracer, and pgxpool picks up the AcquireTracer half automatically.
+type poolTracer struct {
+	store string
+	pool  string
+}
+
+var _ pgx.QueryTracer = (*poolTracer)(nil)
+var _ pgxpool.AcquireTracer = (*poolTracer)(nil)
+
+func (t *poolTracer) TraceAcquireStart(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireStartData) context.Context {
+	ctx, _ = Tracer().Start(ctx, "queryservice.pool.acquire",
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(ATTR_QUERY_STORE.String(t.store), ATTR_DB_POOL.String(t.pool)))
+	return ctx
+}
+
+func (t *poolTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	span := trace.SpanFromContext(ctx)
+	if data.Err != nil {
+		RecordSpanError(span, data.Err)
+	}
+	span.End()
+}
+
+func (t *poolTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	// parameter values are deliberately not recorded since they may contain personal data
+	ctx, _ = Tracer().Start(ctx, "queryservice.query.execute",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			ATTR_QUERY_STORE.String(t.store),
+			ATTR_DB_POOL.String(t.pool),
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", data.SQL),
+		))
+	return ctx
+}
+
+func (t *poolTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	if data.Err != nil {
+		RecordSpanError(span, data.Err)
+	} else {
+		span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	}
+	span.End()
+}
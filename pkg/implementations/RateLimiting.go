@@ -0,0 +1,204 @@
+package implementations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/spf13/viper"
+)
+
+// the scopes a request can be rate limited in, used in the error message and the metrics
+const (
+	RATE_LIMIT_SCOPE_CALLER        = "caller"
+	RATE_LIMIT_SCOPE_METHOD        = "method"
+	RATE_LIMIT_SCOPE_METHOD_CALLER = "method_caller"
+
+	// how often idle per-caller buckets are dropped
+	rateLimitSweepInterval = time.Minute
+)
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second; each request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens gained since the bucket was last used. It returns 0 when there is a token to
+// take, and otherwise how long until there will be.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst float64) time.Duration {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter is a set of token buckets with the same rate and burst, one per key (a caller, or ""
+// for a limit shared by every caller).
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns nil when rate is 0 (no limit). A burst of 0 allows one second's worth of
+// requests at once.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// bucket returns the bucket of key, refilled up to now, and how long until it has a token to take (0
+// when it has one). It must be called with the lock held.
+func (l *rateLimiter) bucket(key string, now time.Time) (*tokenBucket, time.Duration) {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	wait := bucket.refill(now, l.rate, l.burst)
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	return bucket, wait
+}
+
+// sweep drops the buckets that have filled up again, which behave just like new ones. This keeps
+// callers that come and go (e.g. client addresses) from growing the map without bound. It must be
+// called with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// methodRateLimits are the limits a method declares in the queries file.
+type methodRateLimits struct {
+	method  *rateLimiter // rateLimit, shared by every caller
+	callers *rateLimiter // callerRateLimit, per caller
+}
+
+// RateLimits holds a store's token bucket rate limits: the per-caller limit across all of the store's
+// methods (RATE_LIMIT_PER_CALLER, with RATE_LIMIT_BURST), and the rateLimit and callerRateLimit of
+// each method. Callers are told apart by identity on identity-scoped routes and by client address
+// everywhere else, which covers the public routes that need no authentication at all.
+type RateLimits struct {
+	callers *rateLimiter
+	methods map[string]methodRateLimits // written only while the queries file is loaded
+}
+
+// NewRateLimits reads the store-wide rate limit settings from configuration.
+func NewRateLimits(configuration *viper.Viper) (*RateLimits, error) {
+	rate := configuration.GetFloat64(constants.RATE_LIMIT_PER_CALLER)
+	burst := configuration.GetInt(constants.RATE_LIMIT_BURST)
+	if rate < 0 || burst < 0 {
+		return nil, fmt.Errorf("queryservice store - %s and %s may not be negative", constants.RATE_LIMIT_PER_CALLER, constants.RATE_LIMIT_BURST)
+	}
+
+	return &RateLimits{
+		callers: newRateLimiter(rate, burst),
+		methods: make(map[string]methodRateLimits),
+	}, nil
+}
+
+// addMethod sets up the buckets of a method that declares rate limits.
+func (rl *RateLimits) addMethod(method *models.Method) {
+	if method.RateLimit == 0 && method.CallerRateLimit == 0 {
+		return
+	}
+	rl.methods[method.ServiceName+"/"+method.MethodName] = methodRateLimits{
+		method:  newRateLimiter(method.RateLimit, method.RateLimitBurst),
+		callers: newRateLimiter(method.CallerRateLimit, method.RateLimitBurst),
+	}
+}
+
+// rateLimitCheck is one of the buckets a request is subject to.
+type rateLimitCheck struct {
+	limiter *rateLimiter
+	key     string
+	scope   string
+}
+
+// take takes a token from each bucket the request is subject to, or from none of them: when one of
+// them is empty it returns that limit's scope and how long until the request would be allowed, and
+// the other buckets keep their tokens. The buckets are locked together, in the same order every time,
+// so concurrent requests cannot take the last token of a bucket that was just checked.
+func (rl *RateLimits) take(ctx context.Context, method *models.Method) (string, time.Duration) {
+	caller := CallerIdentity(ctx)
+	if caller == "" {
+		caller = ClientAddress(ctx)
+	}
+
+	limits := rl.methods[method.ServiceName+"/"+method.MethodName]
+	checks := make([]rateLimitCheck, 0, 3)
+	if caller != "" {
+		checks = append(checks,
+			rateLimitCheck{rl.callers, caller, RATE_LIMIT_SCOPE_CALLER},
+			rateLimitCheck{limits.callers, caller, RATE_LIMIT_SCOPE_METHOD_CALLER})
+	}
+	checks = append(checks, rateLimitCheck{limits.method, "", RATE_LIMIT_SCOPE_METHOD})
+
+	// held until the tokens are taken
+	var locked []*rateLimiter
+	defer func() {
+		for _, limiter := range locked {
+			limiter.mu.Unlock()
+		}
+	}()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for _, check := range checks {
+		if check.limiter == nil {
+			continue
+		}
+		check.limiter.mu.Lock()
+		locked = append(locked, check.limiter)
+
+		bucket, wait := check.limiter.bucket(check.key, now)
+		if wait > 0 {
+			return check.scope, wait
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return "", 0
+}
+
+// newRateLimitedError is returned for a request over one of its rate limits; the routers send it as
+// 429 with a Retry-After header.
+func newRateLimitedError(scope string, wait time.Duration) *QueryError {
+	message := "Too many requests for this method, please retry later"
+	if scope != RATE_LIMIT_SCOPE_METHOD {
+		message = "Too many requests from this caller, please retry later"
+	}
+	queryErr := NewQueryError(ERROR_RATE_LIMITED, message, nil, nil)
+	queryErr.RetryAfter = wait
+	return queryErr
+}
@@ -0,0 +1,49 @@
+package implementations
+
+import (
+	"context"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// coalesce runs execute once for any number of identical requests (same method, parameters,
+// identity and time zone) that arrive while it is in flight, and hands every caller the same
+// result. This keeps a burst of identical calls, e.g. right after a deploy empties the result
+// cache, from each taking one of the pool's connections. Only methods marked readOnly are
+// coalesced, since a request that shares another's execution does not run the query itself.
+//
+// The shared execution is not canceled when the caller that started it goes away, since other
+// callers may be waiting on it; it keeps that caller's deadline (if any) and its context values.
+// Each caller still stops waiting when its own context is done.
+func (store *BaseQueryStore) coalesce(
+	ctx context.Context,
+	method *models.Method,
+	key string,
+	execute func(context.Context) (*QueryResult, error)) (*QueryResult, error) {
+
+	flight := store.flights.DoChan(key, func() (interface{}, error) {
+		flightCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			flightCtx, cancel = context.WithDeadline(flightCtx, deadline)
+			defer cancel()
+		}
+		return execute(flightCtx)
+	})
+
+	select {
+	case outcome := <-flight:
+		if outcome.Shared {
+			store.metrics.ObserveCoalescedRequest(store.name, method.ServiceName, method.MethodName)
+			trace.SpanFromContext(ctx).SetAttributes(ATTR_COALESCED.Bool(true))
+		}
+		if outcome.Err != nil {
+			return nil, outcome.Err
+		}
+		return outcome.Val.(*QueryResult), nil
+
+	case <-ctx.Done():
+		return nil, newBackendError(ctx.Err())
+	}
+}
@@ -0,0 +1,134 @@
+package implementations
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultResultCacheMaxEntries = 1000
+	defaultResultCacheMaxBytes   = 64 << 20
+)
+
+// ResultCache is an LRU cache of query results for methods that declare a cacheTtlSeconds. It is
+// bounded both by entry count (RESULT_CACHE_MAX_ENTRIES) and by the total size of the cached json
+// (RESULT_CACHE_MAX_BYTES); the least recently used entries are evicted when either is exceeded.
+type ResultCache struct {
+	mu         sync.Mutex
+	storeName  string
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	lru        *list.List // front is the most recently used
+	entries    map[string]*list.Element
+	metrics    *QueryMetrics
+}
+
+type resultCacheEntry struct {
+	key     string
+	result  *QueryResult
+	expires time.Time
+}
+
+// NewResultCache builds the result cache for a store from configuration.
+func NewResultCache(configuration *viper.Viper, storeName string, metrics *QueryMetrics) *ResultCache {
+	maxEntries := configuration.GetInt(constants.RESULT_CACHE_MAX_ENTRIES)
+	if maxEntries <= 0 {
+		maxEntries = defaultResultCacheMaxEntries
+	}
+	maxBytes := configuration.GetInt(constants.RESULT_CACHE_MAX_BYTES)
+	if maxBytes <= 0 {
+		maxBytes = defaultResultCacheMaxBytes
+	}
+
+	return &ResultCache{
+		storeName:  storeName,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		metrics:    metrics,
+	}
+}
+
+// requestKey identifies a request for the result cache and for request coalescing: the method, its
+// parameters sorted by name, and everything else that changes the results (the caller's identity on
+// identity-scoped routes, and the session time zone). The fields are json encoded as an array of
+// strings, so no parameter value can pass for the end of one field and the start of the next.
+func requestKey(ctx context.Context, method *models.Method, callParameters map[string]string) string {
+	names := make([]string, 0, len(callParameters))
+	for name := range callParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, 0, 3+len(names)*2)
+	fields = append(fields, method.ServiceName+"/"+method.MethodName, CallerIdentity(ctx), SessionTimeZone(ctx))
+	for _, name := range names {
+		fields = append(fields, name, callParameters[name])
+	}
+
+	// a []string always marshals
+	key, _ := json.Marshal(fields)
+	return string(key)
+}
+
+// Get returns the cached result for key, if there is one that has not expired.
+func (c *ResultCache) Get(key string) (*QueryResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*resultCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element, "expired")
+		c.metrics.SetCacheSize(c.storeName, len(c.entries), c.bytes)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	return entry.result, true
+}
+
+// Put caches result under key for ttl. Results larger than the whole cache are not cached.
+func (c *ResultCache) Put(key string, result *QueryResult, ttl time.Duration) {
+	size := len(key) + len(result.Body)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element, "replaced")
+	}
+
+	c.entries[key] = c.lru.PushFront(&resultCacheEntry{key: key, result: result, expires: time.Now().Add(ttl)})
+	c.bytes += size
+
+	for len(c.entries) > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.lru.Back(), "capacity")
+	}
+	c.metrics.SetCacheSize(c.storeName, len(c.entries), c.bytes)
+}
+
+// remove must be called with the lock held
+func (c *ResultCache) remove(element *list.Element, reason string) {
+	entry := c.lru.Remove(element).(*resultCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.key) + len(entry.result.Body)
+	c.metrics.ObserveCacheEviction(c.storeName, reason)
+}
@@ -0,0 +1,41 @@
+package implementations
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type sessionTimeZoneKey struct{}
+
+// WithSessionTimeZone returns a context that runs queries with the postgres session TimeZone set to
+// timeZone (an IANA name such as Europe/Paris), and writes timestamptz results in that zone. The
+// routers set it from the X-Timezone request header.
+func WithSessionTimeZone(ctx context.Context, timeZone string) context.Context {
+	if timeZone == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionTimeZoneKey{}, timeZone)
+}
+
+// SessionTimeZone returns the time zone set with WithSessionTimeZone, or "" when there is none.
+func SessionTimeZone(ctx context.Context) string {
+	timeZone, _ := ctx.Value(sessionTimeZoneKey{}).(string)
+	return timeZone
+}
+
+// locations caches loaded zones, since time.LoadLocation reads the zone database on every call
+var locations sync.Map
+
+func cachedLocation(name string) (*time.Location, error) {
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+	return location, nil
+}
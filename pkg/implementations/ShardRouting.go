@@ -0,0 +1,308 @@
+package implementations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
+)
+
+// DEFAULT_DATASOURCE names the default database (DB_CONNECTSTRING) in the shard settings.
+const DEFAULT_DATASOURCE = "default"
+
+// shardMap routes the queries of sharded methods to datasources. SHARD_DATASOURCES lists the shards (a
+// json array of datasource names) in the order the shard key hash picks from, and SHARD_PARTITION_MAP
+// optionally maps shard key values such as partition names to a shard directly
+// ({"US-EAST": "default", "US-WEST": "uswest"}). The instance's own JOURNAL_PARTITION_NAME is
+// mapped to the default database unless the partition map says otherwise.
+type shardMap struct {
+	shards     []*datasource
+	partitions map[string]*datasource
+}
+
+// newShardMap reads the shard settings. It returns nil when SHARD_DATASOURCES is not set.
+func newShardMap(configuration *viper.Viper, datasources map[string]*datasource) (*shardMap, error) {
+	shardSetting := configuration.GetString(constants.SHARD_DATASOURCES)
+	if shardSetting == "" {
+		return nil, nil
+	}
+
+	lookup := func(name string) (*datasource, error) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == DEFAULT_DATASOURCE {
+			name = ""
+		}
+		ds, ok := datasources[name]
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - shard datasource %s is not configured under %s", name, constants.DATASOURCES)
+		}
+		return ds, nil
+	}
+
+	var shardNames []string
+	if err := json.Unmarshal([]byte(shardSetting), &shardNames); err != nil {
+		return nil, fmt.Errorf("queryservice store - unmarshalling of shard datasources JSON from env var %s failed with %w", constants.SHARD_DATASOURCES, err)
+	}
+	if len(shardNames) == 0 {
+		return nil, fmt.Errorf("queryservice store - %s does not list any datasources", constants.SHARD_DATASOURCES)
+	}
+
+	shards := &shardMap{partitions: make(map[string]*datasource)}
+	for _, name := range shardNames {
+		ds, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		shards.shards = append(shards.shards, ds)
+	}
+
+	if partition := configuration.GetString(constants.JOURNAL_PARTITION_NAME); partition != "" {
+		shards.partitions[strings.ToLower(partition)] = datasources[""]
+	}
+
+	if partitionSetting := configuration.GetString(constants.SHARD_PARTITION_MAP); partitionSetting != "" {
+		var partitionNames map[string]string
+		if err := json.Unmarshal([]byte(partitionSetting), &partitionNames); err != nil {
+			return nil, fmt.Errorf("queryservice store - unmarshalling of shard partition map JSON from env var %s failed with %w", constants.SHARD_PARTITION_MAP, err)
+		}
+		for partition, name := range partitionNames {
+			ds, err := lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			shards.partitions[strings.ToLower(partition)] = ds
+		}
+	}
+
+	return shards, nil
+}
+
+// shardFor picks the shard for a shard key value: the partition map when it lists the value, otherwise
+// a hash of the value. Values are compared case insensitively, so GUIDs route the same however they
+// are written.
+func (sm *shardMap) shardFor(value string) *datasource {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if ds, ok := sm.partitions[value]; ok {
+		return ds
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return sm.shards[hash.Sum32()%uint32(len(sm.shards))]
+}
+
+// targetsFor picks the pools a request runs on: the shard picked by the shard key, every shard for
+// scatter-gather methods, and otherwise the datasource the method's serviceName is bound to.
+func (store *BaseQueryStore) targetsFor(method *models.Method, callParameters map[string]string) ([]*storePool, error) {
+	switch {
+	case method.ScatterGather:
+		targets := make([]*storePool, 0, len(store.shards.shards))
+		for _, ds := range store.shards.shards {
+			targets = append(targets, ds.poolFor(method))
+		}
+		return targets, nil
+
+	case method.ShardKey != "":
+		value := strings.TrimSpace(callParameters[method.ShardKey])
+		if value == "" {
+			return nil, NewQueryError(ERROR_INVALID_PARAMS,
+				fmt.Sprintf("queryservice store - the shard key %s must have a value", method.ShardKey), []string{method.ShardKey}, nil)
+		}
+		return []*storePool{store.shards.shardFor(value).poolFor(method)}, nil
+
+	default:
+		return []*storePool{store.datasources[method.Datasource].poolFor(method)}, nil
+	}
+}
+
+// scatterGather runs the query on every shard at once and merges the results. The first shard to fail
+// cancels the others and fails the request, since partial results would be mistaken for complete ones.
+func (store *BaseQueryStore) scatterGather(
+	ctx context.Context,
+	method *models.Method,
+	targets []*storePool,
+	query string,
+	paramMap pgx.NamedArgs,
+	options ReaderOptions) (*QueryResult, error) {
+
+	results := make([]*QueryResult, len(targets))
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i, target := range targets {
+		group.Go(func() error {
+			result, err := store.runQueryWithRetries(groupCtx, method, target, query, paramMap, options)
+			if err != nil {
+				return err
+			}
+			results[i] = result
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	return mergeShardResults(method, results, options)
+}
+
+// mergeShardResults combines the json arrays returned by the shards. The rows are ordered by the
+// method's mergeOrderBy (each shard should already return them in that order) and cut to its
+// mergeLimit, and the method's maxRows/maxResponseBytes then apply to the merged results.
+func mergeShardResults(method *models.Method, results []*QueryResult, options ReaderOptions) (*QueryResult, error) {
+	merged := &QueryResult{}
+	var rows []json.RawMessage
+	for _, result := range results {
+		var shardRows []json.RawMessage
+		if err := json.Unmarshal(result.Body, &shardRows); err != nil {
+			return nil, NewQueryError(ERROR_BACKEND, backendErrorMessage, nil, fmt.Errorf("queryservice store - unable to merge shard results: %w", err))
+		}
+		rows = append(rows, shardRows...)
+		merged.Truncated = merged.Truncated || result.Truncated
+	}
+
+	if method.MergeOrderBy != "" {
+		column, descending, err := method.GetMergeOrder()
+		if err != nil {
+			return nil, NewQueryError(ERROR_BACKEND, backendErrorMessage, nil, err)
+		}
+		keys := make([]interface{}, len(rows))
+		for i, row := range rows {
+			keys[i] = mergeKey(row, column)
+		}
+		order := make([]int, len(rows))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			compared := compareJSONValues(keys[order[a]], keys[order[b]])
+			if descending {
+				return compared > 0
+			}
+			return compared < 0
+		})
+		sorted := make([]json.RawMessage, len(rows))
+		for i, index := range order {
+			sorted[i] = rows[index]
+		}
+		rows = sorted
+	}
+
+	if method.MergeLimit > 0 && len(rows) > method.MergeLimit {
+		rows = rows[:method.MergeLimit]
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteByte('[')
+	for _, row := range rows {
+		if options.MaxRows > 0 && merged.RowCount >= options.MaxRows {
+			if !options.TruncateOnLimit {
+				return nil, limitError(fmt.Sprintf("more than %d rows", options.MaxRows))
+			}
+			merged.Truncated = true
+			break
+		}
+		// +2 leaves room for the separator and the closing bracket
+		if options.MaxResponseBytes > 0 && buffer.Len()+len(row)+2 > options.MaxResponseBytes {
+			if !options.TruncateOnLimit {
+				return nil, limitError(fmt.Sprintf("more than %d bytes", options.MaxResponseBytes))
+			}
+			merged.Truncated = true
+			break
+		}
+
+		if merged.RowCount > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(row)
+		merged.RowCount++
+	}
+	buffer.WriteByte(']')
+	merged.Body = buffer.Bytes()
+
+	return merged, nil
+}
+
+// mergeKey reads the value of column from a result row; rows without it (omitNulls) sort as null.
+func mergeKey(row json.RawMessage, column string) interface{} {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(row, &fields); err != nil {
+		return nil
+	}
+	raw, ok := fields[column]
+	if !ok {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	return value
+}
+
+// compareJSONValues orders json values: nulls first, then booleans, numbers, strings, and anything
+// else by its json text. Numbers written as json strings (numericFormat STRING) compare as text.
+func compareJSONValues(a interface{}, b interface{}) int {
+	rank := func(value interface{}) int {
+		switch value.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case json.Number:
+			return 2
+		case string:
+			return 3
+		default:
+			return 4
+		}
+	}
+	if rankA, rankB := rank(a), rank(b); rankA != rankB {
+		return rankA - rankB
+	}
+
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		default:
+			return 1
+		}
+	case json.Number:
+		floatA, errA := strconv.ParseFloat(string(a), 64)
+		floatB, errB := strconv.ParseFloat(string(b.(json.Number)), 64)
+		if errA == nil && errB == nil {
+			switch {
+			case floatA < floatB:
+				return -1
+			case floatA > floatB:
+				return 1
+			default:
+				return 0
+			}
+		}
+		return strings.Compare(string(a), string(b.(json.Number)))
+	case string:
+		return strings.Compare(a, b.(string))
+	default:
+		textA, _ := json.Marshal(a)
+		textB, _ := json.Marshal(b)
+		return bytes.Compare(textA, textB)
+	}
+}
@@ -1,27 +1,129 @@
 package implementations
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
+	"time"
 
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 type SimpleReader struct {
 	logger     *logrus.Logger
 	rows       pgx.Rows
 	debugLevel int
+	options    ReaderOptions
+}
+
+// ReaderOptions holds the per-method settings (from the queries file) that control how column
+// values are encoded. The zero value gives the default encoding for every type.
+type ReaderOptions struct {
+	NumericFormat   models.NumericFormat
+	OmitNulls       bool // leave null columns (and null composite fields) out of the results instead of writing null
+	TimestampFormat models.TimestampFormat
+	DateFormat      models.DateFormat
+	Location        *time.Location // zone timestamptz values are written in; nil keeps the zone pgx decoded them in
+
+	// result size guardrails (0 means unlimited)
+	MaxRows          int
+	MaxResponseBytes int
+	TruncateOnLimit  bool // stop at the limit and return the rows so far, rather than failing with RESULT_TOO_LARGE
+
+	RawJSON bool // embed json/jsonb columns verbatim instead of decoding and re-encoding them
+
+	types *datasourceTypes // the domains of the datasource the rows come from; set by the store
+}
+
+// NewDefaultReaderOptions returns the service-wide timestamp, date and result size settings from
+// configuration (TIMESTAMP_FORMAT, DATE_FORMAT, TIMESTAMP_TIME_ZONE, MAX_RESULT_ROWS and
+// MAX_RESPONSE_BYTES). Methods may override each of them.
+func NewDefaultReaderOptions(configuration *viper.Viper) (ReaderOptions, error) {
+	options := ReaderOptions{
+		TimestampFormat:  models.TIMESTAMP_AS_RFC3339,
+		DateFormat:       models.DATE_AS_TIMESTAMP,
+		MaxRows:          configuration.GetInt(constants.MAX_RESULT_ROWS),
+		MaxResponseBytes: configuration.GetInt(constants.MAX_RESPONSE_BYTES),
+	}
+
+	var err error
+	if timestampFormat := configuration.GetString(constants.TIMESTAMP_FORMAT); timestampFormat != "" {
+		options.TimestampFormat, err = models.ParseTimestampFormat(timestampFormat)
+		if err != nil {
+			return options, fmt.Errorf("queryservice store - invalid %s setting: %w", constants.TIMESTAMP_FORMAT, err)
+		}
+	}
+	if dateFormat := configuration.GetString(constants.DATE_FORMAT); dateFormat != "" {
+		options.DateFormat, err = models.ParseDateFormat(dateFormat)
+		if err != nil {
+			return options, fmt.Errorf("queryservice store - invalid %s setting: %w", constants.DATE_FORMAT, err)
+		}
+	}
+	if timeZone := configuration.GetString(constants.TIMESTAMP_TIME_ZONE); timeZone != "" {
+		options.Location, err = cachedLocation(timeZone)
+		if err != nil {
+			return options, fmt.Errorf("queryservice store - invalid %s setting: %w", constants.TIMESTAMP_TIME_ZONE, err)
+		}
+	}
+
+	return options, nil
+}
+
+// NewReaderOptions returns the reader options declared on the method, falling back to the
+// service-wide defaults for anything the method leaves unset.
+func NewReaderOptions(defaults ReaderOptions, method *models.Method) (ReaderOptions, error) {
+	options := defaults
+	options.NumericFormat = method.NumericFormat
+	options.OmitNulls = method.OmitNulls
+	options.TruncateOnLimit = method.OnLimit == models.LIMIT_TRUNCATE
+	options.RawJSON = method.RawJson
+
+	if method.MaxRows > 0 {
+		options.MaxRows = method.MaxRows
+	}
+	if method.MaxResponseBytes > 0 {
+		options.MaxResponseBytes = method.MaxResponseBytes
+	}
+
+	if method.TimestampFormat != models.TIMESTAMP_FORMAT_DEFAULT {
+		options.TimestampFormat = method.TimestampFormat
+	}
+	if method.DateFormat != models.DATE_FORMAT_DEFAULT {
+		options.DateFormat = method.DateFormat
+	}
+	if method.TimeZone != "" {
+		location, err := cachedLocation(method.TimeZone)
+		if err != nil {
+			return options, fmt.Errorf("queryservice store - invalid timeZone on method %s/%s: %w", method.ServiceName, method.MethodName, err)
+		}
+		options.Location = location
+	}
+
+	return options, nil
 }
 
 // NewSimpleReader initializes a new SimpleReader
 func NewSimpleReader(rows pgx.Rows, logger *logrus.Logger, debugLevel int) *SimpleReader {
+	return NewSimpleReaderWithOptions(rows, logger, debugLevel, ReaderOptions{})
+}
+
+// NewSimpleReaderWithOptions initializes a new SimpleReader that encodes values per the options
+func NewSimpleReaderWithOptions(rows pgx.Rows, logger *logrus.Logger, debugLevel int, options ReaderOptions) *SimpleReader {
 	return &SimpleReader{
 		rows:       rows,
 		logger:     logger,
 		debugLevel: debugLevel,
+		options:    options,
 	}
 }
 
@@ -48,73 +150,176 @@ func (sr *SimpleReader) GetFieldValue(columnDictionary map[string]interface{}, c
 		return err
 	}
 
+	return sr.addFieldValue(columnDictionary, column, values[column])
+}
+
+// addFieldValue converts one decoded column value and adds it to the column dictionary
+func (sr *SimpleReader) addFieldValue(columnDictionary map[string]interface{}, column int, rawValue interface{}) error {
+
 	// Retrieve the type and value of the column
 	fieldType := sr.rows.FieldDescriptions()[column].DataTypeOID
 
 	if sr.debugLevel > 1 {
 		sr.logger.Infof("name: %v\n", sr.GetFieldName(column))
 		sr.logger.Infof("type: %v\n", fieldType)
-		sr.logger.Infof("val: %v\n", values[column])
+		sr.logger.Infof("val: %v\n", rawValue)
 	}
 
+	value, err := sr.convertValue(fieldType, rawValue)
+	if err != nil {
+		return err
+	}
+
+	if value == nil && sr.options.OmitNulls {
+		return nil
+	}
+
+	// Add the value to the dictionary
+	columnDictionary[sr.GetFieldName(column)] = value
+	return nil
+}
+
+// convertValue converts a value decoded by pgx into the form written to the json results. It is
+// also used for the elements of range and array values, so the same encoding applies wherever a
+// type appears.
+func (sr *SimpleReader) convertValue(fieldType uint32, value interface{}) (interface{}, error) {
+
 	// TODO: Add support/un-support for more data types
-	// TODO: are nulls (from nullable columns) being handled correctly? if not, add something like this:
-	//  if values[column] == nil {
-	//	  columnDictionary[sr.GetFieldName(column)] = nil
-	//	  return nil
-	//  }
+
+	// pgx decodes SQL NULL as nil for every type, so nulls are handled once here and the type
+	// branches below can assume a value is present
+	if value == nil {
+		return nil, nil
+	}
+
+	if elementType, isArray := arrayElementOIDs[fieldType]; isArray {
+		return sr.arrayValue(elementType, value)
+	}
+
 	switch fieldType {
 
 	// explicitly not supported list (so far)
 	case pgtype.UnknownOID, pgtype.XMLOID:
-		return fmt.Errorf("queryservice store - Unsupported field type found in fetched row: %v", fieldType)
+		return nil, fmt.Errorf("queryservice store - Unsupported field type found in fetched row: %v", fieldType)
 
 	// known to work from testing
 	case pgtype.BoolOID,
-		pgtype.TextOID, pgtype.VarcharOID, pgtype.VarcharArrayOID,
-		pgtype.Int4OID, pgtype.Int8OID, pgtype.Int4ArrayOID, pgtype.Int8ArrayOID,
+		pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID,
+		pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID,
 		pgtype.Float4OID, pgtype.Float8OID,
-		pgtype.TimeOID, pgtype.TimestampOID, pgtype.TimestamptzOID,
-		pgtype.DateOID, pgtype.DateArrayOID,
 		pgtype.JSONOID, pgtype.JSONBOID:
 
-		columnDictionary[sr.GetFieldName(column)] = values[column]
+		return value, nil
+
+	// pgx has no binary codec for timetz, so it is read in postgres' own text form (e.g. 10:30:00+02)
+	case pgtype.TimetzOID:
+		return value, nil
 
 	// things that require special handling
 	case pgtype.UUIDOID:
-		uuidArray, ok := values[column].([16]uint8)
+		uuidArray, ok := value.([16]uint8)
 		if !ok {
-			return fmt.Errorf("queryservice store - invalid UUID value %v detected", values[column])
+			return nil, fmt.Errorf("queryservice store - invalid UUID value %v detected", value)
 		}
 
 		uuidValue, err := uuid.FromBytes(uuidArray[:])
 		if err != nil {
-			return fmt.Errorf("queryservice store - unable to convert stored uuid value to a string equivalent: %v\n", err)
+			return nil, fmt.Errorf("queryservice store - unable to convert stored uuid value to a string equivalent: %v\n", err)
+		}
+		return uuidValue.String(), nil
+
+	case pgtype.NumericOID:
+		numeric, ok := value.(pgtype.Numeric)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid NUMERIC value %v detected", value)
 		}
-		columnDictionary[sr.GetFieldName(column)] = uuidValue.String()
+		return sr.numericValue(numeric)
+
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return sr.timestampValue(fieldType, value)
+
+	case pgtype.DateOID:
+		return sr.dateValue(value)
+
+	case pgtype.TimeOID:
+		timeOfDay, ok := value.(pgtype.Time)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid TIME value %v detected", value)
+		}
+		return timeOfDayValue(timeOfDay), nil
+
+	case pgtype.IntervalOID:
+		interval, ok := value.(pgtype.Interval)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid INTERVAL value %v detected", value)
+		}
+		return intervalValue(interval), nil
+
+	case pgtype.Int4rangeOID, pgtype.Int8rangeOID, pgtype.NumrangeOID,
+		pgtype.TsrangeOID, pgtype.TstzrangeOID, pgtype.DaterangeOID:
+		return sr.rangeValue(fieldType, value)
+
+	case pgtype.Int4multirangeOID, pgtype.Int8multirangeOID, pgtype.NummultirangeOID,
+		pgtype.TsmultirangeOID, pgtype.TstzmultirangeOID, pgtype.DatemultirangeOID:
+		return sr.multirangeValue(fieldType, value)
+
+	case pgtype.ByteaOID:
+		bytes, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid BYTEA value %v detected", value)
+		}
+		return base64.StdEncoding.EncodeToString(bytes), nil
+
+	case pgtype.InetOID, pgtype.CIDROID:
+		prefix, ok := value.(netip.Prefix)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid INET/CIDR value %v detected", value)
+		}
+		return networkValue(fieldType, prefix), nil
+
+	case pgtype.MacaddrOID, pgtype.Macaddr8OID:
+		hardwareAddr, ok := value.(net.HardwareAddr)
+		if !ok {
+			return nil, fmt.Errorf("queryservice store - invalid MACADDR value %v detected", value)
+		}
+		return hardwareAddr.String(), nil
+
+	// pgx has no binary codec for money, so it is read as postgres formats it for the server's lc_monetary
+	// (e.g. $1,234.56). Cast to numeric in the query when a plain number is needed.
+	case MONEY_OID:
+		return value, nil
 
 	// optimistic default case for things not tested so far. This is questionable, but so far
 	// the default behavior has worked very well, so leaving it for now.
 	default:
+		if baseType, isDomain := sr.options.types.domainBaseOID(fieldType); isDomain {
+			return sr.convertValue(baseType, value)
+		}
+		if converted, handled, err := sr.customValue(fieldType, value); handled {
+			return converted, err
+		}
+
 		sr.logger.Infof("queryservice store - default assignment of field type used in GetFieldValue(). Consider adding explicit case for this type: %v", fieldType)
-		columnDictionary[sr.GetFieldName(column)] = values[column]
+		return value, nil
 	}
-
-	// Add the value to the dictionary
-	//	columnDictionary[sr.GetFieldName(column)] = value
-	return nil
 }
 
-// ProcessResponse reads all rows and processes each row into a list of dictionaries
+// ProcessResponse reads all rows and processes each row into a list of dictionaries. Only the
+// MaxRows limit applies here; EncodeResponse also enforces MaxResponseBytes.
 func (sr *SimpleReader) ProcessResponse() ([]map[string]interface{}, error) {
 	var result []map[string]interface{}
 
 	for sr.rows.Next() {
-		columnDictionary := make(map[string]interface{})
-		for column := 0; column < sr.GetFieldCount(); column++ {
-			if err := sr.GetFieldValue(columnDictionary, column); err != nil {
-				return nil, err
+		if sr.options.MaxRows > 0 && len(result) >= sr.options.MaxRows {
+			if sr.options.TruncateOnLimit {
+				break
 			}
+			return nil, limitError(fmt.Sprintf("more than %d rows", sr.options.MaxRows))
+		}
+
+		columnDictionary, err := sr.readRow()
+		if err != nil {
+			return nil, err
 		}
 		result = append(result, columnDictionary)
 	}
@@ -126,6 +331,129 @@ func (sr *SimpleReader) ProcessResponse() ([]map[string]interface{}, error) {
 	return result, nil
 }
 
+// EncodeResponse reads the rows and encodes each one into the json array of the result body as it
+// goes, so the rows are held in memory once, as json, rather than also as maps. The body is complete
+// before anything is sent to the caller. Reading stops as soon as the MaxRows or MaxResponseBytes
+// limit would be exceeded; the result is then either marked Truncated or a RESULT_TOO_LARGE error is
+// returned, per TruncateOnLimit. Either way the rest of the rows are still pending, so the caller
+// should cancel the query rather than let Close read them.
+func (sr *SimpleReader) EncodeResponse() (*QueryResult, error) {
+	result := &QueryResult{}
+	var buffer bytes.Buffer
+	buffer.WriteByte('[')
+
+	for sr.rows.Next() {
+		if sr.options.MaxRows > 0 && result.RowCount >= sr.options.MaxRows {
+			if !sr.options.TruncateOnLimit {
+				return nil, limitError(fmt.Sprintf("more than %d rows", sr.options.MaxRows))
+			}
+			result.Truncated = true
+			break
+		}
+
+		columnDictionary, err := sr.readRow()
+		if err != nil {
+			return nil, err
+		}
+		rowJSON, err := json.Marshal(columnDictionary)
+		if err != nil {
+			return nil, fmt.Errorf("queryservice store - failed to marshal valid results returned from query: %w", err)
+		}
+
+		// +2 leaves room for the separator and the closing bracket
+		if sr.options.MaxResponseBytes > 0 && buffer.Len()+len(rowJSON)+2 > sr.options.MaxResponseBytes {
+			if !sr.options.TruncateOnLimit {
+				return nil, limitError(fmt.Sprintf("more than %d bytes", sr.options.MaxResponseBytes))
+			}
+			result.Truncated = true
+			break
+		}
+
+		if result.RowCount > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(rowJSON)
+		result.RowCount++
+	}
+
+	// a truncated read leaves rows unread, so rows.Err() is only meaningful for a complete one
+	if !result.Truncated {
+		if err := sr.rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	buffer.WriteByte(']')
+	result.Body = buffer.Bytes()
+	return result, nil
+}
+
+// readRow decodes the current row once and converts every column into a dictionary
+func (sr *SimpleReader) readRow() (map[string]interface{}, error) {
+	values, err := sr.rowValues()
+	if err != nil {
+		return nil, err
+	}
+
+	columnDictionary := make(map[string]interface{}, len(values))
+	for column, value := range values {
+		if err := sr.addFieldValue(columnDictionary, column, value); err != nil {
+			return nil, err
+		}
+	}
+	return columnDictionary, nil
+}
+
+// rowValues returns the decoded values of the current row. With RawJSON set, json and jsonb columns
+// are returned as the json.RawMessage postgres sent (so documents keep their key order and are not
+// decoded and re-encoded), and every other column is decoded just as rows.Values() would.
+func (sr *SimpleReader) rowValues() ([]interface{}, error) {
+	if !sr.options.RawJSON {
+		return sr.rows.Values()
+	}
+
+	fields := sr.rows.FieldDescriptions()
+	rawValues := sr.rows.RawValues()
+	typeMap := sr.rows.Conn().TypeMap()
+
+	values := make([]interface{}, len(fields))
+	for column, field := range fields {
+		raw := rawValues[column]
+		if raw == nil {
+			continue
+		}
+
+		switch field.DataTypeOID {
+		case pgtype.JSONOID, pgtype.JSONBOID:
+			value, err := rawJSONValue(field, raw)
+			if err != nil {
+				return nil, err
+			}
+			values[column] = value
+			continue
+		}
+
+		if dataType, ok := typeMap.TypeForOID(field.DataTypeOID); ok {
+			value, err := dataType.Codec.DecodeValue(typeMap, field.DataTypeOID, field.Format, raw)
+			if err != nil {
+				return nil, err
+			}
+			values[column] = value
+		} else if field.Format == pgtype.TextFormatCode {
+			values[column] = string(raw)
+		} else {
+			values[column] = bytes.Clone(raw)
+		}
+	}
+
+	return values, nil
+}
+
+func limitError(exceeded string) *QueryError {
+	return NewQueryError(ERROR_TOO_LARGE,
+		fmt.Sprintf("queryservice store - the query returned %s, which is over the limit set for this method. Narrow the request and try again", exceeded), nil, nil)
+}
+
 // PrintAllResults prints all rows for debugging purposes (unused currently)
 func (sr *SimpleReader) PrintAllResults(logger *log.Logger) error {
 
@@ -0,0 +1,432 @@
+package implementations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// The helpers below give the types that pgx decodes into its own structs (which would otherwise be
+// marshalled field by field) a well-defined json form. They are used by SimpleReader.convertValue.
+
+// MONEY_OID is the builtin money type, which pgx does not define a constant (or codec) for
+const MONEY_OID = 790
+
+// MONEY_ARRAY_OID is money[]
+const MONEY_ARRAY_OID = 791
+
+// arrayElementOIDs maps each builtin array type to the type of its elements. Every array column is
+// written as a json array whose elements use the same encoding as a column of the element type.
+// Multi-dimensional arrays are flattened by pgx into a single array in row-major order.
+var arrayElementOIDs = map[uint32]uint32{
+	pgtype.BoolArrayOID:           pgtype.BoolOID,
+	pgtype.ByteaArrayOID:          pgtype.ByteaOID,
+	pgtype.NameArrayOID:           pgtype.NameOID,
+	pgtype.Int2ArrayOID:           pgtype.Int2OID,
+	pgtype.Int4ArrayOID:           pgtype.Int4OID,
+	pgtype.Int8ArrayOID:           pgtype.Int8OID,
+	pgtype.TextArrayOID:           pgtype.TextOID,
+	pgtype.BPCharArrayOID:         pgtype.BPCharOID,
+	pgtype.VarcharArrayOID:        pgtype.VarcharOID,
+	pgtype.Float4ArrayOID:         pgtype.Float4OID,
+	pgtype.Float8ArrayOID:         pgtype.Float8OID,
+	pgtype.NumericArrayOID:        pgtype.NumericOID,
+	MONEY_ARRAY_OID:               MONEY_OID,
+	pgtype.UUIDArrayOID:           pgtype.UUIDOID,
+	pgtype.JSONArrayOID:           pgtype.JSONOID,
+	pgtype.JSONBArrayOID:          pgtype.JSONBOID,
+	pgtype.DateArrayOID:           pgtype.DateOID,
+	pgtype.TimeArrayOID:           pgtype.TimeOID,
+	pgtype.TimetzArrayOID:         pgtype.TimetzOID,
+	pgtype.TimestampArrayOID:      pgtype.TimestampOID,
+	pgtype.TimestamptzArrayOID:    pgtype.TimestamptzOID,
+	pgtype.IntervalArrayOID:       pgtype.IntervalOID,
+	pgtype.InetArrayOID:           pgtype.InetOID,
+	pgtype.CIDRArrayOID:           pgtype.CIDROID,
+	pgtype.MacaddrArrayOID:        pgtype.MacaddrOID,
+	pgtype.Int4rangeArrayOID:      pgtype.Int4rangeOID,
+	pgtype.Int8rangeArrayOID:      pgtype.Int8rangeOID,
+	pgtype.NumrangeArrayOID:       pgtype.NumrangeOID,
+	pgtype.TsrangeArrayOID:        pgtype.TsrangeOID,
+	pgtype.TstzrangeArrayOID:      pgtype.TstzrangeOID,
+	pgtype.DaterangeArrayOID:      pgtype.DaterangeOID,
+	pgtype.Int4multirangeArrayOID: pgtype.Int4multirangeOID,
+	pgtype.Int8multirangeArrayOID: pgtype.Int8multirangeOID,
+	pgtype.NummultirangeArrayOID:  pgtype.NummultirangeOID,
+	pgtype.TsmultirangeArrayOID:   pgtype.TsmultirangeOID,
+	pgtype.TstzmultirangeArrayOID: pgtype.TstzmultirangeOID,
+	pgtype.DatemultirangeArrayOID: pgtype.DatemultirangeOID,
+}
+
+// textOnlyTypes registers codecs for the builtin types pgx does not know about. Without them pgx
+// hands back timetz and money columns as raw text, but arrays of them as unparsed array literals
+// (e.g. {10:00:00+02,11:00:00+02}). Reading them through the text format gives a string per element.
+func textOnlyTypes() []*pgtype.Type {
+	timetzType := &pgtype.Type{Name: "timetz", OID: pgtype.TimetzOID, Codec: &pgtype.TextFormatOnlyCodec{Codec: pgtype.TextCodec{}}}
+	moneyType := &pgtype.Type{Name: "money", OID: MONEY_OID, Codec: &pgtype.TextFormatOnlyCodec{Codec: pgtype.TextCodec{}}}
+
+	return []*pgtype.Type{
+		timetzType,
+		moneyType,
+		{Name: "_timetz", OID: pgtype.TimetzArrayOID, Codec: &pgtype.ArrayCodec{ElementType: timetzType}},
+		{Name: "_money", OID: MONEY_ARRAY_OID, Codec: &pgtype.ArrayCodec{ElementType: moneyType}},
+	}
+}
+
+// rangeElementOIDs maps each builtin range type to the type of its bounds
+var rangeElementOIDs = map[uint32]uint32{
+	pgtype.Int4rangeOID: pgtype.Int4OID,
+	pgtype.Int8rangeOID: pgtype.Int8OID,
+	pgtype.NumrangeOID:  pgtype.NumericOID,
+	pgtype.TsrangeOID:   pgtype.TimestampOID,
+	pgtype.TstzrangeOID: pgtype.TimestamptzOID,
+	pgtype.DaterangeOID: pgtype.DateOID,
+}
+
+// multirangeRangeOIDs maps each builtin multirange type to the range type it holds
+var multirangeRangeOIDs = map[uint32]uint32{
+	pgtype.Int4multirangeOID: pgtype.Int4rangeOID,
+	pgtype.Int8multirangeOID: pgtype.Int8rangeOID,
+	pgtype.NummultirangeOID:  pgtype.NumrangeOID,
+	pgtype.TsmultirangeOID:   pgtype.TsrangeOID,
+	pgtype.TstzmultirangeOID: pgtype.TstzrangeOID,
+	pgtype.DatemultirangeOID: pgtype.DaterangeOID,
+}
+
+// numericValue converts a NUMERIC into its exact decimal text, written as a json number or string
+// per the method's NumericFormat. NaN and +/-Infinity have no json number form and are always strings.
+func (sr *SimpleReader) numericValue(numeric pgtype.Numeric) (interface{}, error) {
+	switch {
+	case !numeric.Valid:
+		return nil, nil
+	case numeric.NaN:
+		return "NaN", nil
+	case numeric.InfinityModifier == pgtype.Infinity:
+		return "Infinity", nil
+	case numeric.InfinityModifier == pgtype.NegativeInfinity:
+		return "-Infinity", nil
+	}
+
+	// MarshalJSON writes the digits and scale exactly as stored (no float64 conversion)
+	text, err := numeric.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("queryservice store - unable to convert stored numeric value to a decimal string: %v", err)
+	}
+
+	if sr.options.NumericFormat == models.NUMERIC_AS_STRING {
+		return string(text), nil
+	}
+	return json.Number(text), nil
+}
+
+// arrayValue converts each element of an array column with the encoding used for elementType.
+// NULL elements stay null.
+func (sr *SimpleReader) arrayValue(elementType uint32, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	elements, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("queryservice store - invalid array value %v detected for element type %v", value, elementType)
+	}
+
+	converted := make([]interface{}, len(elements))
+	for i, element := range elements {
+		if element == nil {
+			continue
+		}
+		convertedElement, err := sr.convertValue(elementType, element)
+		if err != nil {
+			return nil, err
+		}
+		converted[i] = convertedElement
+	}
+
+	return converted, nil
+}
+
+// rangeValue writes a range as {"lower": ..., "upper": ..., "bounds": "[)"}. An unbounded side has a
+// null value (and a parenthesis in bounds, as postgres prints it). An empty range is {"empty": true}.
+func (sr *SimpleReader) rangeValue(rangeType uint32, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	pgRange, ok := value.(pgtype.Range[interface{}])
+	if !ok {
+		return nil, fmt.Errorf("queryservice store - invalid range value %v detected for type %v", value, rangeType)
+	}
+
+	return sr.rangeObject(rangeElementOIDs[rangeType], pgRange)
+}
+
+func (sr *SimpleReader) rangeObject(elementType uint32, pgRange pgtype.Range[interface{}]) (interface{}, error) {
+	if !pgRange.Valid {
+		return nil, nil
+	}
+	if pgRange.LowerType == pgtype.Empty {
+		return map[string]interface{}{"empty": true}, nil
+	}
+
+	result := map[string]interface{}{"lower": nil, "upper": nil}
+	bounds := []byte("()")
+
+	if pgRange.LowerType != pgtype.Unbounded {
+		lower, err := sr.convertValue(elementType, pgRange.Lower)
+		if err != nil {
+			return nil, err
+		}
+		result["lower"] = lower
+		if pgRange.LowerType == pgtype.Inclusive {
+			bounds[0] = '['
+		}
+	}
+
+	if pgRange.UpperType != pgtype.Unbounded {
+		upper, err := sr.convertValue(elementType, pgRange.Upper)
+		if err != nil {
+			return nil, err
+		}
+		result["upper"] = upper
+		if pgRange.UpperType == pgtype.Inclusive {
+			bounds[1] = ']'
+		}
+	}
+
+	result["bounds"] = string(bounds)
+	return result, nil
+}
+
+// multirangeValue writes a multirange as an array of range objects
+func (sr *SimpleReader) multirangeValue(multirangeType uint32, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	multirange, ok := value.(pgtype.Multirange[pgtype.Range[interface{}]])
+	if !ok {
+		return nil, fmt.Errorf("queryservice store - invalid multirange value %v detected for type %v", value, multirangeType)
+	}
+
+	elementType := rangeElementOIDs[multirangeRangeOIDs[multirangeType]]
+	ranges := make([]interface{}, 0, len(multirange))
+	for _, pgRange := range multirange {
+		rangeObject, err := sr.rangeObject(elementType, pgRange)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rangeObject)
+	}
+
+	return ranges, nil
+}
+
+// timestampValue writes a timestamp per the method's TimestampFormat. timestamptz values are moved
+// into the requested zone first; timestamp values have no zone and are written as pgx decodes them
+// (wall clock time marked as UTC). +/-infinity are written as the strings postgres uses.
+func (sr *SimpleReader) timestampValue(fieldType uint32, value interface{}) (interface{}, error) {
+	switch timestamp := value.(type) {
+	case pgtype.InfinityModifier:
+		return timestamp.String(), nil
+	case time.Time:
+		if fieldType == pgtype.TimestamptzOID && sr.options.Location != nil {
+			timestamp = timestamp.In(sr.options.Location)
+		}
+		if sr.options.TimestampFormat == models.TIMESTAMP_AS_EPOCH_MILLIS {
+			return timestamp.UnixMilli(), nil
+		}
+		return timestamp.Format(time.RFC3339Nano), nil
+	default:
+		return nil, fmt.Errorf("queryservice store - invalid timestamp value %v detected for type %v", value, fieldType)
+	}
+}
+
+// dateValue writes a date per the method's DateFormat. Dates have no zone, so the time zone settings
+// never shift them.
+func (sr *SimpleReader) dateValue(value interface{}) (interface{}, error) {
+	switch date := value.(type) {
+	case pgtype.InfinityModifier:
+		return date.String(), nil
+	case time.Time:
+		switch sr.options.DateFormat {
+		case models.DATE_AS_DATE_ONLY:
+			return date.Format(time.DateOnly), nil
+		case models.DATE_AS_EPOCH_MILLIS:
+			return date.UnixMilli(), nil
+		default:
+			return date.Format(time.RFC3339Nano), nil
+		}
+	default:
+		return nil, fmt.Errorf("queryservice store - invalid DATE value %v detected", value)
+	}
+}
+
+// jsonbBinaryVersion is the version byte that prefixes jsonb values in postgres' binary format
+const jsonbBinaryVersion = 1
+
+// rawJSONValue copies a json/jsonb column out of the row buffer (which pgx reuses for the next row)
+// as a json.RawMessage, so it is written into the results exactly as postgres returned it.
+func rawJSONValue(field pgconn.FieldDescription, raw []byte) (json.RawMessage, error) {
+	if field.DataTypeOID == pgtype.JSONBOID && field.Format == pgtype.BinaryFormatCode {
+		if len(raw) == 0 || raw[0] != jsonbBinaryVersion {
+			return nil, fmt.Errorf("queryservice store - unsupported jsonb binary format version in column %s", field.Name)
+		}
+		raw = raw[1:]
+	}
+	return json.RawMessage(bytes.Clone(raw)), nil
+}
+
+// networkValue writes inet and cidr values the way postgres prints them: an inet holding a single
+// host has no mask (10.1.2.3), while networks and every cidr value keep it (10.0.0.0/8).
+func networkValue(fieldType uint32, prefix netip.Prefix) interface{} {
+	if fieldType == pgtype.InetOID && prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// intervalValue writes an interval as an ISO-8601 duration, using the same form as postgres'
+// intervalstyle iso_8601 (each component carries its own sign, e.g. P1Y2M-3DT4H5M6.5S).
+func intervalValue(interval pgtype.Interval) interface{} {
+	if !interval.Valid {
+		return nil
+	}
+
+	var duration strings.Builder
+	duration.WriteString("P")
+
+	years, months := interval.Months/12, interval.Months%12
+	if years != 0 {
+		duration.WriteString(strconv.Itoa(int(years)) + "Y")
+	}
+	if months != 0 {
+		duration.WriteString(strconv.Itoa(int(months)) + "M")
+	}
+	if interval.Days != 0 {
+		duration.WriteString(strconv.Itoa(int(interval.Days)) + "D")
+	}
+
+	microseconds := interval.Microseconds
+	if microseconds != 0 || duration.Len() == 1 {
+		duration.WriteString("T")
+
+		hours := microseconds / 3600000000
+		microseconds -= hours * 3600000000
+		minutes := microseconds / 60000000
+		microseconds -= minutes * 60000000
+
+		if hours != 0 {
+			duration.WriteString(strconv.FormatInt(hours, 10) + "H")
+		}
+		if minutes != 0 {
+			duration.WriteString(strconv.FormatInt(minutes, 10) + "M")
+		}
+		if microseconds != 0 || (hours == 0 && minutes == 0) {
+			duration.WriteString(secondsText(microseconds) + "S")
+		}
+	}
+
+	return duration.String()
+}
+
+// timeOfDayValue writes a TIME as HH:MM:SS with fractional seconds only when present
+func timeOfDayValue(timeOfDay pgtype.Time) interface{} {
+	if !timeOfDay.Valid {
+		return nil
+	}
+
+	microseconds := timeOfDay.Microseconds
+	hours := microseconds / 3600000000
+	microseconds -= hours * 3600000000
+	minutes := microseconds / 60000000
+	microseconds -= minutes * 60000000
+
+	seconds := secondsText(microseconds)
+	if microseconds < 10000000 {
+		seconds = "0" + seconds
+	}
+
+	return fmt.Sprintf("%02d:%02d:%s", hours, minutes, seconds)
+}
+
+// secondsText formats microseconds as seconds, dropping trailing zeros from the fraction
+func secondsText(microseconds int64) string {
+	sign := ""
+	if microseconds < 0 {
+		sign = "-"
+		microseconds = -microseconds
+	}
+
+	text := strconv.FormatInt(microseconds/1000000, 10)
+	if fraction := microseconds % 1000000; fraction != 0 {
+		text += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+	}
+
+	return sign + text
+}
+
+// customValue encodes the user-defined types registered from DB_CUSTOM_TYPES (and arrays of them):
+// enums are written as their label and composites as a json object of their fields. PostGIS
+// geometries are written as GeoJSON. handled is false for any other type.
+func (sr *SimpleReader) customValue(fieldType uint32, value interface{}) (converted interface{}, handled bool, err error) {
+	conn := sr.rows.Conn()
+	if conn == nil {
+		return nil, false, nil
+	}
+	customType, ok := conn.TypeMap().TypeForOID(fieldType)
+	if !ok {
+		return nil, false, nil
+	}
+
+	switch codec := customType.Codec.(type) {
+	case *pgtype.EnumCodec:
+		return value, true, nil
+	case geometryCodec:
+		converted, err = geoJSONValue(value)
+		return converted, true, err
+	case *pgtype.CompositeCodec:
+		converted, err = sr.compositeValue(customType.Name, codec, value)
+		return converted, true, err
+	case *pgtype.ArrayCodec:
+		converted, err = sr.arrayValue(codec.ElementType.OID, value)
+		return converted, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// compositeValue writes a composite (row) value as a json object keyed by field name, encoding each
+// field the same way as a column of its type. NULL fields stay null unless the method omits nulls.
+func (sr *SimpleReader) compositeValue(typeName string, codec *pgtype.CompositeCodec, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("queryservice store - invalid composite value %v detected for type %s", value, typeName)
+	}
+
+	converted := make(map[string]interface{}, len(codec.Fields))
+	for _, field := range codec.Fields {
+		convertedField, err := sr.convertValue(field.Type.OID, fields[field.Name])
+		if err != nil {
+			return nil, err
+		}
+		if convertedField == nil && sr.options.OmitNulls {
+			continue
+		}
+		converted[field.Name] = convertedField
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,146 @@
+package implementations
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	explainTimeout            = 5 * time.Second
+	defaultExplainMaxInFlight = 1
+	defaultExplainSampleRate  = 1.0
+)
+
+// SlowQueryLog writes an entry for every query request that takes longer than the configured
+// threshold. Entries go through a dedicated logger entry (logger=slow-query) so they can be routed
+// or filtered separately from the regular service logs, and they are written at Warn level so
+// they show up without turning on debug.
+//
+// Plans are fetched on the same pool as the queries, so they are capped: only
+// SLOW_QUERY_EXPLAIN_SAMPLE_RATE of the slow queries get one, and no more than
+// SLOW_QUERY_EXPLAIN_MAX_IN_FLIGHT run at a time. A database that slows everything down thus does
+// not also have to serve an EXPLAIN per request; the queries over the cap are logged without a plan.
+type SlowQueryLog struct {
+	threshold  time.Duration
+	explain    bool
+	sampleRate float64
+	explains   chan struct{} // a semaphore holding a slot per EXPLAIN in flight
+	logger     *logrus.Entry
+	rootCtx    context.Context
+}
+
+// NewSlowQueryLog returns nil when SLOW_QUERY_THRESHOLD_MS is not set (or is zero).
+func NewSlowQueryLog(configuration *viper.Viper, logger *logrus.Logger, storeName string, rootCtx context.Context) *SlowQueryLog {
+	thresholdMs := configuration.GetInt(constants.SLOW_QUERY_THRESHOLD_MS)
+	if thresholdMs <= 0 {
+		return nil
+	}
+
+	sampleRate := defaultExplainSampleRate
+	if configuration.IsSet(constants.SLOW_QUERY_EXPLAIN_SAMPLE_RATE) {
+		sampleRate = configuration.GetFloat64(constants.SLOW_QUERY_EXPLAIN_SAMPLE_RATE)
+	}
+	maxInFlight := defaultExplainMaxInFlight
+	if configured := configuration.GetInt(constants.SLOW_QUERY_EXPLAIN_MAX_IN_FLIGHT); configured > 0 {
+		maxInFlight = configured
+	}
+
+	return &SlowQueryLog{
+		threshold:  time.Duration(thresholdMs) * time.Millisecond,
+		explain:    configuration.GetBool(constants.SLOW_QUERY_EXPLAIN) && sampleRate > 0,
+		sampleRate: sampleRate,
+		explains:   make(chan struct{}, maxInFlight),
+		logger:     logger.WithFields(logrus.Fields{"logger": "slow-query", "store": storeName}),
+		rootCtx:    rootCtx,
+	}
+}
+
+// Check logs the request if it exceeded the threshold. When SLOW_QUERY_EXPLAIN is set, the plan of a
+// sampled query is fetched on a separate connection of the pool the query ran on (target), after
+// the fact so the caller's response is not delayed. No plan is fetched from a replica that is out
+// of rotation.
+func (sq *SlowQueryLog) Check(
+	method *models.Method,
+	target *storePool,
+	callParameters map[string]string,
+	paramMap pgx.NamedArgs,
+	elapsed time.Duration,
+	rowCount int,
+	err error) {
+
+	if sq == nil || elapsed < sq.threshold {
+		return
+	}
+
+	entry := sq.logger.WithFields(logrus.Fields{
+		"service":     method.ServiceName,
+		"method":      method.MethodName,
+		"params":      method.GetRedactedParameters(callParameters),
+		"duration_ms": elapsed.Milliseconds(),
+		"rows":        rowCount,
+	})
+	if err != nil {
+		entry = entry.WithField("error", err.Error())
+	}
+
+	if target != nil {
+		entry = entry.WithField("pool", target.name)
+	}
+
+	if !sq.explain || paramMap == nil || target == nil {
+		entry.Warn("queryservice store - slow query detected")
+		return
+	}
+
+	if target.replica && !target.healthy.Load() {
+		entry.WithField("plan_skipped", "replica out of rotation").Warn("queryservice store - slow query detected")
+		return
+	}
+	if sq.sampleRate < 1 && rand.Float64() >= sq.sampleRate {
+		entry.Warn("queryservice store - slow query detected")
+		return
+	}
+	select {
+	case sq.explains <- struct{}{}:
+	default:
+		entry.WithField("plan_skipped", "too many plans in flight").Warn("queryservice store - slow query detected")
+		return
+	}
+
+	go func() {
+		defer func() { <-sq.explains }()
+
+		plan, explainErr := sq.explainPlan(target.pool, method.GetQueryStringInCallableFormat(), paramMap)
+		if explainErr != nil {
+			entry.WithField("plan_error", explainErr.Error()).Warn("queryservice store - slow query detected")
+			return
+		}
+		entry.WithField("plan", plan).Warn("queryservice store - slow query detected")
+	}()
+}
+
+func (sq *SlowQueryLog) explainPlan(dbPool *pgxpool.Pool, query string, paramMap pgx.NamedArgs) (string, error) {
+	ctx, cancel := context.WithTimeout(sq.rootCtx, explainTimeout)
+	defer cancel()
+
+	rows, err := dbPool.Query(ctx, "EXPLAIN (ANALYZE off) "+strings.TrimRight(strings.TrimSpace(query), ";"), paramMap)
+	if err != nil {
+		return "", err
+	}
+
+	planLines, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(planLines, "\n"), nil
+}
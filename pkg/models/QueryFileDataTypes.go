@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 // DataTypes represents the available data types that can be used for parameters in the queries file(s) (so far).
@@ -24,6 +25,16 @@ const (
 	ARRAY_VARCHAR
 	ARRAY_INTEGER
 	ARRAY_DATE
+	NUMERIC
+	BYTES
+	INET
+	ARRAY_GUID
+	ARRAY_BOOLEAN
+	ARRAY_LONG
+	ARRAY_DOUBLE
+	ARRAY_TIMESTAMP
+	ARRAY_NUMERIC
+	GEOJSON
 )
 
 // UnmarshalJSON customizes the JSON decoding for DataType, parsing the string into an enum.
@@ -63,6 +74,26 @@ func (dt *DataType) UnmarshalJSON(b []byte) error {
 		*dt = ARRAY_INTEGER
 	case "ARRAY_DATE":
 		*dt = ARRAY_DATE
+	case "NUMERIC":
+		*dt = NUMERIC
+	case "BYTES":
+		*dt = BYTES
+	case "INET":
+		*dt = INET
+	case "ARRAY_GUID":
+		*dt = ARRAY_GUID
+	case "ARRAY_BOOLEAN":
+		*dt = ARRAY_BOOLEAN
+	case "ARRAY_LONG":
+		*dt = ARRAY_LONG
+	case "ARRAY_DOUBLE":
+		*dt = ARRAY_DOUBLE
+	case "ARRAY_TIMESTAMP":
+		*dt = ARRAY_TIMESTAMP
+	case "ARRAY_NUMERIC":
+		*dt = ARRAY_NUMERIC
+	case "GEOJSON":
+		*dt = GEOJSON
 	default:
 		return fmt.Errorf("queryservice models - invalid query parameter data type detected in UnmarshalJson: %s", s)
 	}
@@ -92,3 +123,167 @@ func (mt *MethodType) UnmarshalJSON(b []byte) error {
 	}
 	return nil
 }
+
+// NumericFormat controls how NUMERIC/DECIMAL columns are written in a method's results. Numbers are
+// written with every digit Postgres returned either way; STRING exists for clients whose json parser
+// would round large or very precise values into a float64.
+type NumericFormat int
+
+const (
+	NUMERIC_AS_NUMBER NumericFormat = iota
+	NUMERIC_AS_STRING
+)
+
+// UnmarshalJSON customizes the JSON decoding for NumericFormat, parsing the string into an enum.
+func (nf *NumericFormat) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("queryservice models - failed to unmarshal JSON for NumericFormat: %w", err)
+	}
+
+	// Map the string to the corresponding enum value
+	switch s {
+	case "NUMBER":
+		*nf = NUMERIC_AS_NUMBER
+	case "STRING":
+		*nf = NUMERIC_AS_STRING
+	default:
+		return fmt.Errorf("queryservice models - invalid NumericFormat %s detected on query", s)
+	}
+	return nil
+}
+
+// TimestampFormat controls how TIMESTAMP/TIMESTAMPTZ columns are written in a method's results. The
+// default defers to the service-wide TIMESTAMP_FORMAT setting, which is itself RFC3339 when unset.
+type TimestampFormat int
+
+const (
+	TIMESTAMP_FORMAT_DEFAULT TimestampFormat = iota
+	TIMESTAMP_AS_RFC3339
+	TIMESTAMP_AS_EPOCH_MILLIS
+)
+
+// ParseTimestampFormat maps the name used in the queries file and configuration to the enum.
+func ParseTimestampFormat(s string) (TimestampFormat, error) {
+	switch s {
+	case "RFC3339":
+		return TIMESTAMP_AS_RFC3339, nil
+	case "EPOCH_MILLIS":
+		return TIMESTAMP_AS_EPOCH_MILLIS, nil
+	default:
+		return TIMESTAMP_FORMAT_DEFAULT, fmt.Errorf("queryservice models - invalid TimestampFormat %s detected", s)
+	}
+}
+
+// UnmarshalJSON customizes the JSON decoding for TimestampFormat, parsing the string into an enum.
+func (tf *TimestampFormat) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("queryservice models - failed to unmarshal JSON for TimestampFormat: %w", err)
+	}
+
+	format, err := ParseTimestampFormat(s)
+	if err != nil {
+		return err
+	}
+	*tf = format
+	return nil
+}
+
+// DateFormat controls how DATE columns are written in a method's results. The default defers to the
+// service-wide DATE_FORMAT setting, which is itself TIMESTAMP (midnight UTC in RFC3339) when unset.
+type DateFormat int
+
+const (
+	DATE_FORMAT_DEFAULT DateFormat = iota
+	DATE_AS_TIMESTAMP
+	DATE_AS_DATE_ONLY
+	DATE_AS_EPOCH_MILLIS
+)
+
+// ParseDateFormat maps the name used in the queries file and configuration to the enum.
+func ParseDateFormat(s string) (DateFormat, error) {
+	switch s {
+	case "TIMESTAMP":
+		return DATE_AS_TIMESTAMP, nil
+	case "DATE_ONLY":
+		return DATE_AS_DATE_ONLY, nil
+	case "EPOCH_MILLIS":
+		return DATE_AS_EPOCH_MILLIS, nil
+	default:
+		return DATE_FORMAT_DEFAULT, fmt.Errorf("queryservice models - invalid DateFormat %s detected", s)
+	}
+}
+
+// UnmarshalJSON customizes the JSON decoding for DateFormat, parsing the string into an enum.
+func (df *DateFormat) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("queryservice models - failed to unmarshal JSON for DateFormat: %w", err)
+	}
+
+	format, err := ParseDateFormat(s)
+	if err != nil {
+		return err
+	}
+	*df = format
+	return nil
+}
+
+// LimitAction controls what happens when a method's results exceed its maxRows or maxResponseBytes.
+type LimitAction int
+
+const (
+	LIMIT_ERROR LimitAction = iota
+	LIMIT_TRUNCATE
+)
+
+// UnmarshalJSON customizes the JSON decoding for LimitAction, parsing the string into an enum.
+func (la *LimitAction) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("queryservice models - failed to unmarshal JSON for LimitAction: %w", err)
+	}
+
+	// Map the string to the corresponding enum value
+	switch s {
+	case "ERROR":
+		*la = LIMIT_ERROR
+	case "TRUNCATE":
+		*la = LIMIT_TRUNCATE
+	default:
+		return fmt.Errorf("queryservice models - invalid LimitAction %s detected on query", s)
+	}
+	return nil
+}
+
+// Consistency controls which of the store's pools a method's query runs on when read replicas are
+// configured. Methods default to the primary.
+type Consistency int
+
+const (
+	CONSISTENCY_PRIMARY Consistency = iota
+	CONSISTENCY_REPLICA             // a healthy replica, or the primary when none is healthy
+	CONSISTENCY_ANY                 // spread across the primary and the healthy replicas
+)
+
+// UnmarshalJSON customizes the JSON decoding for Consistency, parsing the string into an enum.
+func (c *Consistency) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("queryservice models - failed to unmarshal JSON for Consistency: %w", err)
+	}
+
+	// Map the string to the corresponding enum value
+	switch strings.ToLower(s) {
+	case "primary":
+		*c = CONSISTENCY_PRIMARY
+	case "replica":
+		*c = CONSISTENCY_REPLICA
+	case "any":
+		*c = CONSISTENCY_ANY
+	default:
+		return fmt.Errorf("queryservice models - invalid Consistency %s detected on query", s)
+	}
+	return nil
+}
@@ -1,14 +1,20 @@
 package models
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v5"
+	pgxtype "github.com/jackc/pgx/v5/pgtype"
 	"github.com/sirupsen/logrus"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/geojson"
 )
 
 // QueryParam represents a query parameter used in a query.
@@ -16,6 +22,7 @@ type QueryParam struct {
 	Name     string
 	Type     DataType
 	Optional bool
+	LogValue bool // values are redacted in the slow-query log unless this is set
 }
 
 // Method represents the method that can be called.
@@ -29,6 +36,38 @@ type Method struct {
 	MethodType      MethodType // Assuming MethodType is already defined in your enums (as we discussed earlier)
 	Query           string
 	QueryParameters []QueryParam // Assuming QueryParam is another struct that represents query parameters
+	NumericFormat   NumericFormat
+	OmitNulls       bool // null columns are left out of each result row rather than written as null
+	TimestampFormat TimestampFormat
+	DateFormat      DateFormat
+	TimeZone        string // IANA zone timestamptz values are written in (e.g. America/Chicago); X-Timezone overrides it
+	RawJson         bool   // json/jsonb columns are embedded as returned by postgres rather than decoded and re-encoded
+
+	// result size guardrails
+	MaxRows          int         // 0 uses the service-wide MAX_RESULT_ROWS (itself unlimited when unset)
+	MaxResponseBytes int         // 0 uses the service-wide MAX_RESPONSE_BYTES (itself unlimited when unset)
+	OnLimit          LimitAction // ERROR (413) or TRUNCATE when either limit is reached
+
+	CacheTtlSeconds int  // results are cached in memory for this long when set; only for data that may be served stale
+	ReadOnly        bool // the query has no side effects, so identical concurrent requests share one execution and serialization failures (SQLSTATE 40001) are retried too
+
+	// conditional requests
+	CacheControl string // Cache-Control header sent with the results (e.g. "private, max-age=30")
+	VersionQuery string // single-value query (e.g. max(updated_at)) whose result is the ETag; without one the ETag hashes the results
+
+	Consistency Consistency // primary (default), replica or any; only matters when read replicas are configured
+	Datasource  string      // named datasource (DATASOURCES.<name>) for the serviceName; the default database when unset
+
+	// token bucket rate limits, in requests per second
+	RateLimit       float64 // across all callers of the method
+	CallerRateLimit float64 // for each caller identity, or client address on routes without one
+	RateLimitBurst  int     // requests allowed at once before the limits apply; one second's worth when unset
+
+	// shard routing (SHARD_DATASOURCES)
+	ShardKey      string // parameter whose value picks the shard the query runs on
+	ScatterGather bool   // the query runs on every shard and the results are merged
+	MergeOrderBy  string // column (optionally followed by ASC or DESC) the merged results are ordered by
+	MergeLimit    int    // the merged results are cut to this many rows when set
 }
 
 // GetQueryParameterNames returns the names of the query parameters, optionally filtering by required parameters.
@@ -48,6 +87,21 @@ func (m *Method) GetQueryParameterNames(onlyRequired bool) []string {
 	return response
 }
 
+// ParameterError is returned by GetMapOfParametersForQueryCall when a call parameter cannot be
+// converted to the type declared for it in the queries file.
+type ParameterError struct {
+	Name string
+	Err  error
+}
+
+func (e *ParameterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParameterError) Unwrap() error {
+	return e.Err
+}
+
 // GetMapOfParametersForQueryCall converts the provided call parameters into a map
 // suitable for use in a PostgreSQL query. It handles array types by unmarshalling
 // JSON strings into Go slices.
@@ -61,7 +115,7 @@ func (m *Method) GetMapOfParametersForQueryCall(callParams map[string]string) (p
 			var stringArray []string
 			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &stringArray)
 			if err != nil {
-				return nil, fmt.Errorf("queryservice models - error unmarshalling array of strings for parameter %s: %v", queryParam.Name, err)
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of strings for parameter %s: %v", queryParam.Name, err)}
 			}
 			paramMap[queryParam.Name] = stringArray
 
@@ -70,7 +124,7 @@ func (m *Method) GetMapOfParametersForQueryCall(callParams map[string]string) (p
 			var integerArray []int
 			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &integerArray)
 			if err != nil {
-				return nil, fmt.Errorf("queryservice models - error unmarshalling array of integers for parameter %s: %v", queryParam.Name, err)
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of integers for parameter %s: %v", queryParam.Name, err)}
 			}
 			paramMap[queryParam.Name] = integerArray
 
@@ -79,10 +133,138 @@ func (m *Method) GetMapOfParametersForQueryCall(callParams map[string]string) (p
 			var dateArray []pgtype.Date
 			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &dateArray)
 			if err != nil {
-				return nil, fmt.Errorf("queryservice models - error unmarshalling array of dates for parameter %s: %v", queryParam.Name, err)
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of dates for parameter %s: %v", queryParam.Name, err)}
 			}
 			paramMap[queryParam.Name] = dateArray
 
+		case ARRAY_GUID:
+			// Parse here so that a malformed uuid is reported against the parameter. null elements are passed as NULL.
+			var guidArray []pgxtype.UUID
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &guidArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of guids for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = guidArray
+
+		case ARRAY_BOOLEAN:
+			var booleanArray []bool
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &booleanArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of booleans for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = booleanArray
+
+		case ARRAY_LONG:
+			var longArray []int64
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &longArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of longs for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = longArray
+
+		case ARRAY_DOUBLE:
+			var doubleArray []float64
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &doubleArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of doubles for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = doubleArray
+
+		case ARRAY_TIMESTAMP:
+			// Elements are RFC 3339 timestamps (e.g. "2024-01-02T03:04:05Z"), the same form timestamp columns are returned in
+			var timestampArray []time.Time
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &timestampArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of timestamps for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = timestampArray
+
+		case ARRAY_NUMERIC:
+			// Elements may be json numbers or strings (the two forms numeric columns are returned in) so that
+			// values too precise for a float survive the trip. null elements are passed as NULL.
+			var rawArray []json.RawMessage
+			err := json.Unmarshal([]byte(callParams[queryParam.Name]), &rawArray)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error unmarshalling array of numerics for parameter %s: %v", queryParam.Name, err)}
+			}
+			numericArray := make([]pgxtype.Numeric, len(rawArray))
+			for i, raw := range rawArray {
+				element := strings.Trim(string(raw), `"`)
+				if element == "null" {
+					continue
+				}
+				err = numericArray[i].Scan(element)
+				if err != nil {
+					return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error parsing numeric element %d for parameter %s: %v", i, queryParam.Name, err)}
+				}
+			}
+			paramMap[queryParam.Name] = numericArray
+
+		case NUMERIC:
+			// Parse here so that a malformed decimal is reported against the parameter rather than as a database error.
+			// An omitted optional parameter is passed as NULL.
+			value, exists := callParams[queryParam.Name]
+			if !exists {
+				paramMap[queryParam.Name] = nil
+				continue
+			}
+			var numeric pgxtype.Numeric
+			err := numeric.Scan(value)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error parsing numeric value for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = numeric
+
+		case BYTES:
+			// Binary values are passed as standard base64 (the same form bytea columns are returned in)
+			value, exists := callParams[queryParam.Name]
+			if !exists {
+				paramMap[queryParam.Name] = nil
+				continue
+			}
+			bytes, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error decoding base64 value for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = bytes
+
+		case INET:
+			// Accepts a single address (10.1.2.3) or a network (10.0.0.0/8) so queries can filter with << and >>=
+			value, exists := callParams[queryParam.Name]
+			if !exists {
+				paramMap[queryParam.Name] = nil
+				continue
+			}
+			if strings.Contains(value, "/") {
+				prefix, err := netip.ParsePrefix(value)
+				if err != nil {
+					return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error parsing network value for parameter %s: %v", queryParam.Name, err)}
+				}
+				paramMap[queryParam.Name] = prefix
+			} else {
+				addr, err := netip.ParseAddr(value)
+				if err != nil {
+					return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error parsing address value for parameter %s: %v", queryParam.Name, err)}
+				}
+				paramMap[queryParam.Name] = addr
+			}
+
+		case GEOJSON:
+			// A GeoJSON geometry object, bound to ST_GeomFromGeoJSON in the query (see GetQueryStringInCallableFormat).
+			// It is parsed here so that malformed shapes are reported against the parameter. PostGIS gives the
+			// geometry SRID 4326 unless the object names another in a "crs" member.
+			value, exists := callParams[queryParam.Name]
+			if !exists {
+				paramMap[queryParam.Name] = nil
+				continue
+			}
+			var geometry geom.T
+			err := geojson.Unmarshal([]byte(value), &geometry)
+			if err != nil {
+				return nil, &ParameterError{Name: queryParam.Name, Err: fmt.Errorf("queryservice models - error parsing GeoJSON value for parameter %s: %v", queryParam.Name, err)}
+			}
+			paramMap[queryParam.Name] = value
+
 		default:
 			// Add the parameter to the map
 			// WARNING: using the default here is based on the knowledge that all allowed types may be
@@ -94,16 +276,47 @@ func (m *Method) GetMapOfParametersForQueryCall(callParams map[string]string) (p
 	return paramMap, nil
 }
 
+// GetRedactedParameters returns a copy of the call parameters that is safe to log. Values are replaced
+// with a placeholder unless the parameter is marked with "logValue": true in the queries file.
+func (m *Method) GetRedactedParameters(callParams map[string]string) map[string]string {
+	redacted := make(map[string]string, len(callParams))
+	for name, value := range callParams {
+		redacted[name] = "[REDACTED]"
+		for _, queryParam := range m.QueryParameters {
+			if queryParam.Name == name && queryParam.LogValue {
+				redacted[name] = value
+				break
+			}
+		}
+	}
+	return redacted
+}
+
 // GetQueryStringInCallableFormat returns the query string with query parameter placeholders
 // in PostgreSQL format.
 // It replaces the placeholders in the query string with '@' notation for PostgreSQL.
 func (m *Method) GetQueryStringInCallableFormat() string {
+	return m.callableFormat(m.Query)
+}
+
+// GetVersionQueryStringInCallableFormat returns the version query with its parameter placeholders in
+// PostgreSQL format, as GetQueryStringInCallableFormat does for the query.
+func (m *Method) GetVersionQueryStringInCallableFormat() string {
+	return m.callableFormat(m.VersionQuery)
+}
+
+func (m *Method) callableFormat(query string) string {
 	// Start with the original query
-	pgQuery := m.Query
+	pgQuery := query
 
 	// Replace placeholders with '@' notation for PostgreSQL
 	for _, queryParam := range m.QueryParameters {
-		pgQuery = strings.ReplaceAll(pgQuery, "{"+queryParam.Name+"}", "@"+queryParam.Name)
+		placeholder := "@" + queryParam.Name
+		if queryParam.Type == GEOJSON {
+			// PostGIS parses the GeoJSON; the cast picks the text overload of ST_GeomFromGeoJSON
+			placeholder = "ST_GeomFromGeoJSON(" + placeholder + "::text)"
+		}
+		pgQuery = strings.ReplaceAll(pgQuery, "{"+queryParam.Name+"}", placeholder)
 	}
 	return pgQuery
 }
@@ -111,13 +324,17 @@ func (m *Method) GetQueryStringInCallableFormat() string {
 // GetParameterNamesFromQueryString extracts the parameter names from the query string
 // using regex. Freaking regex voodoo.  You swear you'll never use it, then... ;)
 func (m *Method) GetParameterNamesFromQueryString() []string {
+	return parameterNamesIn(m.Query)
+}
+
+func parameterNamesIn(query string) []string {
 	paramsInQuery := make(map[string]struct{})
 	pattern := `\{([a-zA-Z0-9](?:[a-zA-Z0-9_-]*[a-zA-Z0-9])?)\}` // TESTING this as a better pattern
 	//	pattern := `\{([a-zA-Z0-9]*)\}`
 
 	// Compile regex pattern
 	re := regexp.MustCompile(pattern)
-	matches := re.FindAllStringSubmatch(m.Query, -1)
+	matches := re.FindAllStringSubmatch(query, -1)
 
 	// Add matched parameter names to the set
 	for _, match := range matches {
@@ -189,3 +406,100 @@ func (m *Method) ValidateQueryParamsWithQuery(logger *logrus.Logger) bool {
 	}).Error("queryservice models - found query definition with inconsistent param count in the queries file.")
 	return false
 }
+
+// ValidateVersionQuery checks that the version query, if there is one, only uses parameters declared
+// for the method. It may use fewer of them than the query does.
+func (m *Method) ValidateVersionQuery(logger *logrus.Logger) bool {
+	validParams := true
+	for _, param := range parameterNamesIn(m.VersionQuery) {
+		declared := false
+		for _, q := range m.QueryParameters {
+			if q.Name == param {
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			logger.WithFields(logrus.Fields{
+				"service": m.ServiceName,
+				"method":  m.MethodName,
+				"param":   param,
+			}).Error("queryservice models - found version query using an undeclared param name in the queries file.")
+			validParams = false
+		}
+	}
+	return validParams
+}
+
+// GetMergeOrder returns the column and direction of the method's mergeOrderBy ("createdAt DESC").
+func (m *Method) GetMergeOrder() (column string, descending bool, err error) {
+	fields := strings.Fields(m.MergeOrderBy)
+	switch {
+	case len(fields) == 1:
+		return fields[0], false, nil
+	case len(fields) == 2 && strings.EqualFold(fields[1], "ASC"):
+		return fields[0], false, nil
+	case len(fields) == 2 && strings.EqualFold(fields[1], "DESC"):
+		return fields[0], true, nil
+	default:
+		return "", false, fmt.Errorf("queryservice models - invalid mergeOrderBy %q, expected a column optionally followed by ASC or DESC", m.MergeOrderBy)
+	}
+}
+
+// ValidateShardSettings checks the method's shard routing settings: the shard key must be a required
+// parameter, and the merge settings only apply to scatter-gather methods.
+func (m *Method) ValidateShardSettings(logger *logrus.Logger) bool {
+	fields := logrus.Fields{"service": m.ServiceName, "method": m.MethodName}
+
+	if m.ShardKey != "" {
+		if m.ScatterGather {
+			logger.WithFields(fields).Error("queryservice models - found query definition with both a shardKey and scatterGather in the queries file.")
+			return false
+		}
+		declared := false
+		for _, q := range m.QueryParameters {
+			if q.Name == m.ShardKey && !q.Optional {
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			logger.WithFields(fields).WithField("param", m.ShardKey).Error("queryservice models - found query definition whose shardKey is not a required param in the queries file.")
+			return false
+		}
+	}
+
+	if !m.ScatterGather && (m.MergeOrderBy != "" || m.MergeLimit != 0) {
+		logger.WithFields(fields).Error("queryservice models - found query definition with merge settings but without scatterGather in the queries file.")
+		return false
+	}
+	if m.MergeOrderBy != "" {
+		if _, _, err := m.GetMergeOrder(); err != nil {
+			logger.WithFields(fields).Error(err.Error())
+			return false
+		}
+	}
+	if m.MergeLimit < 0 {
+		logger.WithFields(fields).Error("queryservice models - found query definition with a negative mergeLimit in the queries file.")
+		return false
+	}
+
+	return true
+}
+
+// ValidateRateLimits checks the method's rate limits: they may not be negative, and a burst needs a
+// limit to apply to.
+func (m *Method) ValidateRateLimits(logger *logrus.Logger) bool {
+	fields := logrus.Fields{"service": m.ServiceName, "method": m.MethodName}
+
+	if m.RateLimit < 0 || m.CallerRateLimit < 0 || m.RateLimitBurst < 0 {
+		logger.WithFields(fields).Error("queryservice models - found query definition with a negative rate limit in the queries file.")
+		return false
+	}
+	if m.RateLimitBurst > 0 && m.RateLimit == 0 && m.CallerRateLimit == 0 {
+		logger.WithFields(fields).Error("queryservice models - found query definition with a rateLimitBurst but without a rateLimit or callerRateLimit in the queries file.")
+		return false
+	}
+
+	return true
+}
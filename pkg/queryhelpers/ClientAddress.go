@@ -0,0 +1,30 @@
+package queryhelpers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+)
+
+// clientAddress returns the address of the client that sent r, which rate limits callers on routes
+// that are not identity scoped. Behind a load balancer or proxy (TRUST_X_FORWARDED_FOR) it is the
+// last address in X-Forwarded-For, the one the proxy added: the ones before it come from the client
+// and are easily forged.
+func clientAddress(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwardedFor := r.Header.Get(constants.FORWARDED_FOR_HEADER); forwardedFor != "" {
+			addresses := strings.Split(forwardedFor, ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
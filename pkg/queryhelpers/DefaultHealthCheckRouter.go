@@ -91,6 +91,28 @@ func (h *HealthCheckRouter) GetHealthStandalone(w http.ResponseWriter, r *http.R
 		health.DependencyStatus["database"] = sbconstants.HEALTH_STATUS_HEALTHY
 	}
 
+	// the other datasources, and the read replicas; an unhealthy replica leaves the service healthy,
+	// since its queries fail over to the primary
+	for _, pool := range h.store.PoolHealthCheck() {
+		if pool.Err != nil {
+			h.Logger.Info("queryservice healthcheck router - the ping of database pool ", pool.Name, " in GetHealthStandalone failed with: ", pool.Err)
+			health.DependencyStatus["database-"+pool.Name] = sbconstants.HEALTH_STATUS_UNHEALTHY
+			if !pool.Replica {
+				health.Status = sbconstants.HEALTH_STATUS_UNHEALTHY
+			}
+		} else {
+			health.DependencyStatus["database-"+pool.Name] = sbconstants.HEALTH_STATUS_HEALTHY
+		}
+	}
+
+	// an open circuit breaker means queries on that datasource are failing fast
+	for _, circuit := range h.store.CircuitHealthCheck() {
+		health.DependencyStatus["database-"+circuit.Name] = circuit.State.String()
+		if circuit.State == implementations.CIRCUIT_OPEN {
+			health.Status = sbconstants.HEALTH_STATUS_UNHEALTHY
+		}
+	}
+
 	err = h.GetListOfCalledServices(&health)
 	if err != nil {
 		h.Logger.Info("queryservice healthcheck router - failed to retrieve called services in GetHealthStandalone: ", err)
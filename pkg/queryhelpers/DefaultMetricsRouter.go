@@ -0,0 +1,71 @@
+package queryhelpers
+
+// It is not required to use this helper implementation, but it is provided as a convenience
+// since the code is likely to be identical for each noun service.
+//
+
+import (
+	"net/http"
+
+	"github.com/geraldhinson/siftd-base/pkg/security"
+	"github.com/geraldhinson/siftd-base/pkg/serviceBase"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/implementations"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type MetricsRouter struct {
+	*serviceBase.ServiceBase
+	handler    http.Handler
+	debugLevel int
+}
+
+// NewMetricsRouter exposes the prometheus metrics (per-method query stats and pgx pool stats)
+// collected by the query stores on /metrics.
+func NewMetricsRouter(
+	service *serviceBase.ServiceBase,
+	realm string,
+	authType security.AuthTypes,
+	timeout security.AuthTimeout,
+	approved []string) *MetricsRouter {
+
+	var debugLevel = 0
+	if service.Configuration.GetString(constants.DEBUGSIFTD_QUERYHELPERS) != "" {
+		debugLevel = service.Configuration.GetInt(constants.DEBUGSIFTD_QUERYHELPERS)
+	}
+
+	// make sure the query collectors are registered even if no store has been created yet
+	implementations.GetQueryMetrics()
+
+	authModel, err := service.NewAuthModel(realm, authType, timeout, approved)
+	if err != nil {
+		service.Logger.Error("queryservice metrics router - failed to initialize AuthModel with: ", err)
+		return nil
+	}
+
+	metricsRouter := &MetricsRouter{
+		ServiceBase: service,
+		handler:     promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}),
+		debugLevel:  debugLevel,
+	}
+
+	metricsRouter.setupRoutes(authModel)
+
+	return metricsRouter
+}
+
+func (m *MetricsRouter) setupRoutes(authModel *security.AuthModel) {
+
+	var routeString = "/metrics"
+	m.RegisterRoute(constants.HTTP_GET, routeString, authModel, m.GetMetrics)
+
+}
+
+func (m *MetricsRouter) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	if m.debugLevel > 1 {
+		m.Logger.Infof("queryservice metrics router - incoming metrics request: %s", r.URL.Path)
+	}
+
+	m.handler.ServeHTTP(w, r)
+}
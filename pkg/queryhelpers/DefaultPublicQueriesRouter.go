@@ -17,8 +17,10 @@ import (
 
 type PublicQueriesRouter struct {
 	*serviceBase.ServiceBase
-	store      *implementations.BaseQueryStore
-	debugLevel int
+	store             *implementations.BaseQueryStore
+	compression       *ResponseCompression
+	trustForwardedFor bool
+	debugLevel        int
 }
 
 func NewPublicQueriesRouter(
@@ -50,10 +52,18 @@ func NewPublicQueriesRouter(
 		return nil
 	}
 
+	compression, err := NewResponseCompression(service.Configuration)
+	if err != nil {
+		service.Logger.Errorf("queryservice public queries router - failed to configure response compression with: %v", err)
+		return nil
+	}
+
 	publicQueriesRouter := &PublicQueriesRouter{
-		ServiceBase: service,
-		store:       store,
-		debugLevel:  debugLevel,
+		ServiceBase:       service,
+		store:             store,
+		compression:       compression,
+		trustForwardedFor: service.Configuration.GetBool(constants.TRUST_X_FORWARDED_FOR),
+		debugLevel:        debugLevel,
 	}
 
 	err = publicQueriesRouter.setupRoutes(queryMethod2AuthModel_Mapping)
@@ -153,6 +163,15 @@ func (s *PublicQueriesRouter) handleGetQueryList(w http.ResponseWriter, r *http.
 		}
 	}()
 
+	cw := s.compression.Wrap(w, r)
+	defer func() {
+		// the encoder writes its final frame on close, so a failure here leaves the client a truncated body
+		if err := cw.Close(); err != nil {
+			s.Logger.Errorf("queryservice public queries router - Failed to finish the response (request %s): %v", getRequestId(cw, r), err)
+		}
+	}()
+	w = cw
+
 	if s.debugLevel > 0 {
 		s.Logger.Infof("queryservice public queries router - incoming request to get the list of defined queries")
 	}
@@ -161,7 +180,7 @@ func (s *PublicQueriesRouter) handleGetQueryList(w http.ResponseWriter, r *http.
 	if err != nil {
 		s.Logger.Info("queryservice public queries router - Failed to run query: ", err)
 
-		writeHttpResponse(w, http.StatusBadRequest, []byte(err.Error()))
+		writeErrorResponse(w, getRequestId(w, r), err)
 		return
 	}
 
@@ -177,6 +196,15 @@ func (s *PublicQueriesRouter) handlePublicQueries(w http.ResponseWriter, r *http
 		}
 	}()
 
+	cw := s.compression.Wrap(w, r)
+	defer func() {
+		// the encoder writes its final frame on close, so a failure here leaves the client a truncated body
+		if err := cw.Close(); err != nil {
+			s.Logger.Errorf("queryservice public queries router - Failed to finish the response (request %s): %v", getRequestId(cw, r), err)
+		}
+	}()
+	w = cw
+
 	params := getURLPathParams(s.Logger, "/v1/public/queries/", r)
 	// TODD: test the nil case here (params)
 	queryParams := s.GetQueryParams(r)
@@ -185,24 +213,49 @@ func (s *PublicQueriesRouter) handlePublicQueries(w http.ResponseWriter, r *http
 		s.Logger.Infof("queryservice public queries router - incoming request to run the query: %s/%s", params["serviceName"], params["methodName"])
 	}
 
-	jsonResults, err := s.store.RunStandAloneQuery(params["serviceName"], params["methodName"], queryParams)
+	requestId := getRequestId(w, r)
+	ctx, span := startRequestSpan(r, requestId, params)
+	ctx = implementations.WithSessionTimeZone(ctx, strings.TrimSpace(r.Header.Get(constants.TIMEZONE_HEADER)))
+	ctx = implementations.WithIfNoneMatch(ctx, r.Header.Get(constants.IF_NONE_MATCH_HEADER))
+	ctx = implementations.WithClientAddress(ctx, clientAddress(r, s.trustForwardedFor))
+
+	result, err := s.store.RunStandAloneQueryWithResult(ctx, params["serviceName"], params["methodName"], queryParams)
 	if err != nil {
-		s.Logger.Info("queryservice public queries router - Failed to run query: ", err)
+		s.Logger.Infof("queryservice public queries router - Failed to run query (request %s): %v", requestId, err)
 
-		// check if err contains our constant indicating an internal server error and return 500 if it does
-		if strings.Contains(err.Error(), constants.INTERNAL_SERVER_ERROR) {
-			writeHttpResponse(w, http.StatusInternalServerError, []byte(err.Error()))
-		} else {
-			writeHttpResponse(w, http.StatusBadRequest, []byte(err.Error()))
-		}
+		status := writeErrorResponse(w, requestId, err)
+		endRequestSpan(span, status, err)
 		return
 	}
 
 	if s.debugLevel > 0 == true {
-		s.Logger.Println("queryservice public queries router - the result from RunStandAloneQuery() was: ", string(jsonResults))
+		s.Logger.Println("queryservice public queries router - the result from RunStandAloneQuery() was: ", string(result.Body))
 	}
 
-	writeHttpResponse(w, http.StatusOK, jsonResults)
+	status := writeQueryResult(w, result)
+	endRequestSpan(span, status, nil)
+}
+
+// writeQueryResult writes the results of a query request along with their caching headers, or just the
+// headers with a 304 when the request's If-None-Match matched. It returns the http status used.
+func writeQueryResult(w http.ResponseWriter, result *implementations.QueryResult) int {
+	if result.ETag != "" {
+		w.Header().Set(constants.ETAG_HEADER, result.ETag)
+	}
+	if result.CacheControl != "" {
+		w.Header().Set(constants.CACHE_CONTROL_HEADER, result.CacheControl)
+	}
+
+	if result.NotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return http.StatusNotModified
+	}
+
+	if result.Truncated {
+		w.Header().Set(constants.TRUNCATED_HEADER, "true")
+	}
+	writeHttpResponse(w, http.StatusOK, result.Body)
+	return http.StatusOK
 }
 
 func writeHttpResponse(w http.ResponseWriter, status int, v []byte) {
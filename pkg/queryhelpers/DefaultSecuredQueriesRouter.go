@@ -20,8 +20,10 @@ import (
 
 type SecuredQueriesRouter struct {
 	*serviceBase.ServiceBase
-	store      *implementations.BaseQueryStore
-	debugLevel int
+	store             *implementations.BaseQueryStore
+	compression       *ResponseCompression
+	trustForwardedFor bool
+	debugLevel        int
 }
 
 func NewSecuredQueriesRouter(
@@ -53,10 +55,18 @@ func NewSecuredQueriesRouter(
 		return nil
 	}
 
+	compression, err := NewResponseCompression(service.Configuration)
+	if err != nil {
+		service.Logger.Errorf("queryservice secured queries router - failed to configure response compression with: %v", err)
+		return nil
+	}
+
 	securedQueriesRouter := &SecuredQueriesRouter{
-		ServiceBase: service,
-		store:       store,
-		debugLevel:  debugLevel,
+		ServiceBase:       service,
+		store:             store,
+		compression:       compression,
+		trustForwardedFor: service.Configuration.GetBool(constants.TRUST_X_FORWARDED_FOR),
+		debugLevel:        debugLevel,
 	}
 
 	err = securedQueriesRouter.setupRoutes(queryMethod2AuthModel_Mapping)
@@ -108,6 +118,15 @@ func (s *SecuredQueriesRouter) handleGetQueryList(w http.ResponseWriter, r *http
 		}
 	}()
 
+	cw := s.compression.Wrap(w, r)
+	defer func() {
+		// the encoder writes its final frame on close, so a failure here leaves the client a truncated body
+		if err := cw.Close(); err != nil {
+			s.Logger.Errorf("queryservice secured queries router - Failed to finish the response (request %s): %v", getRequestId(cw, r), err)
+		}
+	}()
+	w = cw
+
 	if s.debugLevel > 0 {
 		s.Logger.Infof("queryservice secured queries router - incoming request to get the list of defined queries")
 	}
@@ -116,7 +135,7 @@ func (s *SecuredQueriesRouter) handleGetQueryList(w http.ResponseWriter, r *http
 	if err != nil {
 		s.Logger.Info("queryservice secured queries router - Failed to run query: ", err)
 
-		writeHttpResponse(w, http.StatusBadRequest, []byte(err.Error()))
+		writeErrorResponse(w, getRequestId(w, r), err)
 		return
 	}
 
@@ -140,7 +159,8 @@ func (s *SecuredQueriesRouter) handleIdentityRequiredQueries(w http.ResponseWrit
 	urlParams := getURLPathParams(s.Logger, "/queries/", r)
 	if urlParams == nil {
 		s.Logger.Infof("queryservice secured queries router - Invalid URL path detected on incoming request - unable to find prefix in path: %s\n", r.URL.Path)
-		writeHttpResponse(w, http.StatusBadRequest, []byte("Invalid URL path detected on incoming request - unable to find prefix in path"))
+		writeErrorResponse(w, getRequestId(w, r), implementations.NewQueryError(implementations.ERROR_INVALID_PARAMS,
+			"Invalid URL path detected on incoming request - unable to find prefix in path", nil, nil))
 		return
 	}
 	queryParams := s.GetQueryParams(r)
@@ -173,24 +193,37 @@ func (s *SecuredQueriesRouter) handleNonIdentityRequiredQueries(w http.ResponseW
 
 func (s *SecuredQueriesRouter) baseQueryHandler(w http.ResponseWriter, r *http.Request, urlParams map[string]string, queryParams map[string]string) {
 
-	jsonResults, err := s.store.RunStandAloneQuery(urlParams["serviceName"], urlParams["methodName"], queryParams)
+	cw := s.compression.Wrap(w, r)
+	defer func() {
+		// the encoder writes its final frame on close, so a failure here leaves the client a truncated body
+		if err := cw.Close(); err != nil {
+			s.Logger.Errorf("queryservice secured queries router - Failed to finish the response (request %s): %v", getRequestId(cw, r), err)
+		}
+	}()
+	w = cw
+
+	requestId := getRequestId(w, r)
+	ctx, span := startRequestSpan(r, requestId, urlParams)
+	ctx = implementations.WithSessionTimeZone(ctx, strings.TrimSpace(r.Header.Get(constants.TIMEZONE_HEADER)))
+	ctx = implementations.WithCallerIdentity(ctx, urlParams["identityId"])
+	ctx = implementations.WithIfNoneMatch(ctx, r.Header.Get(constants.IF_NONE_MATCH_HEADER))
+	ctx = implementations.WithClientAddress(ctx, clientAddress(r, s.trustForwardedFor))
+
+	result, err := s.store.RunStandAloneQueryWithResult(ctx, urlParams["serviceName"], urlParams["methodName"], queryParams)
 	if err != nil {
-		s.Logger.Info("queryservice secured queries router - Failed to run query: ", err)
+		s.Logger.Infof("queryservice secured queries router - Failed to run query (request %s): %v", requestId, err)
 
-		// check if err contains our constant indicating an internal server error and return 500 if it does
-		if strings.Contains(err.Error(), constants.INTERNAL_SERVER_ERROR) {
-			writeHttpResponse(w, http.StatusInternalServerError, []byte(err.Error()))
-		} else {
-			writeHttpResponse(w, http.StatusBadRequest, []byte(err.Error()))
-		}
+		status := writeErrorResponse(w, requestId, err)
+		endRequestSpan(span, status, err)
 		return
 	}
 
 	if s.debugLevel > 1 {
-		s.Logger.Println("queryservice secured queries router - the result from RunStandAloneQuery() was: ", string(jsonResults))
+		s.Logger.Println("queryservice secured queries router - the result from RunStandAloneQuery() was: ", string(result.Body))
 	}
 
-	writeHttpResponse(w, http.StatusOK, jsonResults)
+	status := writeQueryResult(w, result)
+	endRequestSpan(span, status, nil)
 }
 
 func getURLPathParams(logger *logrus.Logger, pathContains string, r *http.Request) map[string]string {
@@ -0,0 +1,61 @@
+package queryhelpers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/implementations"
+	"github.com/google/uuid"
+)
+
+// ErrorResponse is the json body returned for every failed query request.
+type ErrorResponse struct {
+	Code      implementations.ErrorCode `json:"code"`
+	Message   string                    `json:"message"`
+	Params    []string                  `json:"params,omitempty"`
+	RequestId string                    `json:"requestId"`
+}
+
+// getRequestId returns the id used to correlate a request with the logs. An incoming X-Request-Id is
+// reused, otherwise a new one is generated. The id is echoed back on the response header.
+func getRequestId(w http.ResponseWriter, r *http.Request) string {
+	if requestId := w.Header().Get(constants.REQUEST_ID_HEADER); requestId != "" {
+		return requestId
+	}
+
+	requestId := r.Header.Get(constants.REQUEST_ID_HEADER)
+	if requestId == "" {
+		requestId = uuid.NewString()
+	}
+	w.Header().Set(constants.REQUEST_ID_HEADER, requestId)
+
+	return requestId
+}
+
+// writeErrorResponse writes the json error envelope for err and returns the http status used.
+func writeErrorResponse(w http.ResponseWriter, requestId string, err error) int {
+	queryErr := implementations.AsQueryError(err)
+
+	body, marshalErr := json.Marshal(ErrorResponse{
+		Code:      queryErr.Code,
+		Message:   queryErr.Message,
+		Params:    queryErr.Params,
+		RequestId: requestId,
+	})
+	if marshalErr != nil {
+		body = []byte(`{"code":"` + string(implementations.ERROR_BACKEND) + `"}`)
+	}
+
+	if queryErr.RetryAfter > 0 {
+		// whole seconds, rounded up so that clients never come back early
+		w.Header().Set(constants.RETRY_AFTER_HEADER, strconv.Itoa(int((queryErr.RetryAfter+time.Second-1)/time.Second)))
+	}
+
+	status := queryErr.HttpStatus()
+	writeHttpResponse(w, status, body)
+
+	return status
+}
@@ -0,0 +1,45 @@
+package queryhelpers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/implementations"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the W3C propagators are used directly (rather than the global one) so that incoming traceparent
+// headers are honored even when the service has not configured a global propagator.
+var requestPropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// startRequestSpan continues any trace passed in on the request headers and starts the server span
+// for a query request. The caller must End() the returned span.
+func startRequestSpan(r *http.Request, requestId string, urlParams map[string]string) (context.Context, trace.Span) {
+	ctx := requestPropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("siftd.request.id", requestId),
+		implementations.ATTR_QUERY_SERVICE.String(urlParams["serviceName"]),
+		implementations.ATTR_QUERY_METHOD.String(urlParams["methodName"]),
+	}
+	if urlParams["identityId"] != "" {
+		attrs = append(attrs, implementations.ATTR_IDENTITY_ID.String(urlParams["identityId"]))
+	}
+
+	return implementations.Tracer().Start(ctx, "queryservice.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// endRequestSpan records the response status (and error, if any) on the request span and ends it.
+func endRequestSpan(span trace.Span, status int, err error) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if err != nil {
+		implementations.RecordSpanError(span, err)
+	}
+	span.End()
+}
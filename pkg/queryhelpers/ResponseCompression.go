@@ -0,0 +1,250 @@
+package queryhelpers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/viper"
+)
+
+const (
+	ENCODING_ZSTD   = "zstd"
+	ENCODING_BROTLI = "br"
+	ENCODING_GZIP   = "gzip"
+
+	defaultCompressionEncodings = ENCODING_ZSTD + "," + ENCODING_BROTLI + "," + ENCODING_GZIP
+	defaultCompressionMinBytes  = 1024
+)
+
+// resetWriteCloser is what the gzip, brotli and zstd writers have in common, which lets them be
+// pooled and reused across responses.
+type resetWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// the encoder levels favor speed; the json results compress well even at the fastest settings
+var encoderPools = map[string]*sync.Pool{
+	ENCODING_ZSTD: {New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+	ENCODING_BROTLI: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	ENCODING_GZIP: {New: func() interface{} {
+		encoder, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return encoder
+	}},
+}
+
+// ResponseCompression negotiates the Content-Encoding of query responses with the client's
+// Accept-Encoding. The encodings offered, in order of preference, are set with
+// COMPRESSION_ENCODINGS ("none" turns compression off) and responses smaller than
+// COMPRESSION_MIN_BYTES are sent as is.
+type ResponseCompression struct {
+	encodings []string
+	minBytes  int
+}
+
+// NewResponseCompression reads the compression settings from configuration.
+func NewResponseCompression(configuration *viper.Viper) (*ResponseCompression, error) {
+	setting := strings.TrimSpace(configuration.GetString(constants.COMPRESSION_ENCODINGS))
+	if setting == "" {
+		setting = defaultCompressionEncodings
+	}
+
+	compression := &ResponseCompression{minBytes: defaultCompressionMinBytes}
+	if configuration.IsSet(constants.COMPRESSION_MIN_BYTES) {
+		compression.minBytes = configuration.GetInt(constants.COMPRESSION_MIN_BYTES)
+	}
+
+	if strings.EqualFold(setting, "none") {
+		return compression, nil
+	}
+	for _, encoding := range strings.Split(setting, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if _, ok := encoderPools[encoding]; !ok {
+			return nil, fmt.Errorf("queryservice queries router - unsupported encoding %q in %s (expected a list of %s)", encoding, constants.COMPRESSION_ENCODINGS, defaultCompressionEncodings)
+		}
+		compression.encodings = append(compression.encodings, encoding)
+	}
+
+	return compression, nil
+}
+
+// negotiate picks the encoding for a request: the one with the highest q-value in Accept-Encoding,
+// and among equal q-values the one listed first in COMPRESSION_ENCODINGS. It returns "" when the
+// client accepts none of them.
+func (c *ResponseCompression) negotiate(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		accepted[name] = quality
+	}
+
+	chosen, chosenQuality := "", 0.0
+	for _, encoding := range c.encodings {
+		quality, ok := accepted[encoding]
+		if !ok {
+			quality, ok = accepted["*"]
+		}
+		if ok && quality > chosenQuality {
+			chosen, chosenQuality = encoding, quality
+		}
+	}
+	return chosen
+}
+
+// Wrap returns a writer that compresses what the handler writes to w when the request accepts one of
+// the configured encodings. The handler must Close it once the response is written.
+func (c *ResponseCompression) Wrap(w http.ResponseWriter, r *http.Request) *CompressingResponseWriter {
+	cw := &CompressingResponseWriter{ResponseWriter: w, minBytes: c.minBytes}
+	if len(c.encodings) == 0 {
+		cw.passThrough = true
+		return cw
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	cw.encoding = c.negotiate(r.Header.Get("Accept-Encoding"))
+	cw.passThrough = cw.encoding == ""
+	return cw
+}
+
+// CompressingResponseWriter holds back the start of the response until it knows whether the body
+// reaches the size threshold, then either compresses everything written to it or sends it as is.
+// Bodies written in several pieces are compressed as they arrive, so once the threshold is reached
+// nothing more is held back, and a Flush before then starts the compressed stream early.
+type CompressingResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minBytes    int
+	passThrough bool
+	status      int
+	pending     []byte
+	encoder     resetWriteCloser
+	closed      bool
+}
+
+func (cw *CompressingResponseWriter) WriteHeader(status int) {
+	if cw.passThrough {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < http.StatusOK {
+		// no body to compress
+		cw.passThrough = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *CompressingResponseWriter) Write(p []byte) (int, error) {
+	if cw.passThrough {
+		return cw.ResponseWriter.Write(p)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+
+	cw.pending = append(cw.pending, p...)
+	if len(cw.pending) < cw.minBytes {
+		return len(p), nil
+	}
+	if err := cw.startEncoding(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been written so far. A body still under the threshold is compressed from
+// here on regardless, since the headers go out with the first bytes; before anything was written
+// there is nothing to send, and the headers are held back.
+func (cw *CompressingResponseWriter) Flush() {
+	if !cw.passThrough && cw.encoder == nil {
+		if len(cw.pending) == 0 || cw.startEncoding() != nil {
+			return
+		}
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the response: it completes the compressed stream, or writes a body that stayed
+// under the threshold uncompressed.
+func (cw *CompressingResponseWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	if cw.encoder != nil {
+		err := cw.encoder.Close()
+		cw.encoder.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.encoder)
+		cw.encoder = nil
+		return err
+	}
+	if cw.passThrough {
+		return nil
+	}
+
+	cw.passThrough = true
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	if len(cw.pending) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(cw.pending)
+	return err
+}
+
+func (cw *CompressingResponseWriter) startEncoding() error {
+	header := cw.Header()
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	// the compressed bytes differ from the ones the ETag was computed over
+	if etag := header.Get(constants.ETAG_HEADER); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set(constants.ETAG_HEADER, "W/"+etag)
+	}
+
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(status)
+
+	cw.encoder = encoderPools[cw.encoding].Get().(resetWriteCloser)
+	cw.encoder.Reset(cw.ResponseWriter)
+
+	pending := cw.pending
+	cw.pending = nil
+	_, err := cw.encoder.Write(pending)
+	return err
+}
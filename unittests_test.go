@@ -1,21 +1,36 @@
 package unittests
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/geraldhinson/siftd-base/pkg/security"
 	"github.com/geraldhinson/siftd-base/pkg/serviceBase"
 	"github.com/geraldhinson/siftd-queryservice-base/pkg/constants"
+	"github.com/geraldhinson/siftd-queryservice-base/pkg/implementations"
 	"github.com/geraldhinson/siftd-queryservice-base/pkg/models"
 	"github.com/geraldhinson/siftd-queryservice-base/pkg/queryhelpers"
+	"github.com/klauspost/compress/zstd"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // this is a map of query defined auth property to actual auth policies.
@@ -47,7 +62,12 @@ var policyTranslation = &models.QueryFileAuthPoliciesList{
 	},
 }
 
+// spans are exported in-memory so the tracing tests do not need a collector
+var spanExporter = tracetest.NewInMemoryExporter()
+
 func TestCalls(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+
 	router, err := NewQueriesService()
 	if err != nil {
 		t.Fatalf("Failed to start listener: %v", err)
@@ -115,6 +135,1017 @@ func TestCalls(t *testing.T) {
 		}
 	})
 
+	t.Run("GET json by id - missing parameter returns error envelope", func(t *testing.T) {
+		headers := map[string]string{constants.REQUEST_ID_HEADER: "unittest-request-id"}
+		body, err, status := CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getJsonById", headers)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+
+		var errorResponse queryhelpers.ErrorResponse
+		if err := json.Unmarshal(body, &errorResponse); err != nil {
+			t.Fatalf("Expected a json error envelope, got %s", string(body))
+		}
+		if errorResponse.Code != implementations.ERROR_MISSING_PARAMS {
+			t.Fatalf("Expected code %s, got %s", implementations.ERROR_MISSING_PARAMS, errorResponse.Code)
+		}
+		if len(errorResponse.Params) != 1 || errorResponse.Params[0] != "id" {
+			t.Fatalf("Expected the missing param 'id' to be reported, got %v", errorResponse.Params)
+		}
+		if errorResponse.RequestId != "unittest-request-id" {
+			t.Fatalf("Expected the incoming request id to be echoed back, got %s", errorResponse.RequestId)
+		}
+	})
+
+	t.Run("GET numeric values - exact decimals returned as strings", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getNumericValues?amount=12345678901234567890.123456789")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `"amount":"12345678901234567890.123456789"`) ||
+			!strings.Contains(string(body), `"doubled":"24691357802469135780.246913578"`) {
+			t.Fatalf("Expected exact decimal strings in json returned, got %s", string(body))
+		}
+	})
+
+	t.Run("GET numeric values - malformed NUMERIC parameter", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getNumericValues?amount=12.3.4")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+		if !strings.Contains(string(body), `"params":["amount"]`) {
+			t.Fatalf("Expected the amount param to be reported, got %s", string(body))
+		}
+	})
+
+	t.Run("GET temporal values - interval, time and range encoding", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getTemporalValues")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"anInterval":"P1Y2M3DT4H5M6.5S"`,
+			`"aTime":"10:20:30"`,
+			`"aTimetz":"10:20:30+02"`,
+			`"anInt4range":{"bounds":"[)","lower":1,"upper":5}`,
+			// postgres canonicalizes discrete ranges to [) so the inclusive upper bound comes back exclusive
+			`"aDaterange":{"bounds":"()","lower":null`,
+			`"anEmptyRange":{"empty":true}`,
+			`"anInt4multirange":[{"bounds":"[)","lower":1,"upper":3},{"bounds":"[)","lower":7,"upper":9}]`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET network values - inet, cidr, macaddr, bytea and money encoding", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getNetworkValues?network=10.0.0.0/8&payload=aGVsbG8%3D")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"inNetwork":true`,
+			`"anInet":"10.1.2.3"`,
+			`"aCidr":"10.0.0.0/8"`,
+			`"aMacaddr":"08:00:2b:01:02:03"`,
+			`"aBytea":"aGVsbG8="`,
+			`12.34"`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET array values - array parameters and array column encoding", func(t *testing.T) {
+		query := url.Values{}
+		query.Set("ids", `["6f1a2b3c-0000-4000-8000-000000000001",null]`)
+		query.Set("flags", `[true,false]`)
+		query.Set("amounts", `["1.10",2,null]`)
+		query.Set("stamps", `["2024-01-02T03:04:05Z"]`)
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getArrayValues?"+query.Encode())
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"guids":["6f1a2b3c-0000-4000-8000-000000000001",null]`,
+			`"flags":[true,false]`,
+			`"amounts":[1.10,2,null]`,
+			`"intervals":["P1D",null]`,
+			`"timetzs":["10:00:00+02"]`,
+			`"ranges":[{"bounds":"[)","lower":1,"upper":5}]`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET array values - malformed guid array", func(t *testing.T) {
+		query := url.Values{}
+		query.Set("ids", `["not-a-guid"]`)
+		query.Set("flags", `[]`)
+		query.Set("amounts", `[]`)
+		query.Set("stamps", `[]`)
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getArrayValues?"+query.Encode())
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+		if !strings.Contains(string(body), `"params":["ids"]`) {
+			t.Fatalf("Expected the ids param to be reported, got %s", string(body))
+		}
+	})
+
+	t.Run("GET null values - null columns of every type are written as null", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getNullValues")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"aUuid":null`,
+			`"aNumeric":null`,
+			`"anInterval":null`,
+			`"anInet":null`,
+			`"aBytea":null`,
+			`"aRange":null`,
+			`"aUuidArray":null`,
+			`"aNullUuidElement":[null]`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET null values - omitNulls leaves null columns out", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getNullValuesOmitted")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `[{"aText":"present"}]`) {
+			t.Fatalf("Expected only the non-null column, got %s", string(body))
+		}
+	})
+
+	t.Run("GET zoned timestamps - method time zone and date-only format", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getZonedTimestamps")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"aTimestamptz":"2024-01-02T03:04:05Z"`,
+			`"aDate":"2024-01-02"`,
+			`"anInfinity":"infinity"`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET zoned timestamps - X-Timezone header sets the session and output zone", func(t *testing.T) {
+		headers := map[string]string{constants.TIMEZONE_HEADER: "Asia/Tokyo"}
+		body, err, status := CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getZonedTimestamps", headers)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"aTimestamptz":"2024-01-02T12:04:05+09:00"`,
+			`"aDate":"2024-01-02"`,
+			`"sessionZone":"Asia/Tokyo"`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET zoned timestamps - unknown X-Timezone", func(t *testing.T) {
+		headers := map[string]string{constants.TIMEZONE_HEADER: "Mars/Olympus_Mons"}
+		_, err, status := CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getZonedTimestamps", headers)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+	})
+
+	t.Run("GET epoch timestamps - epoch millis format", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getEpochTimestamps")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `"aTimestamptz":1704164645000`) || !strings.Contains(string(body), `"aDate":1704153600000`) {
+			t.Fatalf("Expected epoch millisecond values, got %s", string(body))
+		}
+	})
+
+	t.Run("GET truncated rows - maxRows with TRUNCATE", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getTruncatedRows")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if string(body) != `[{"rowNumber":1},{"rowNumber":2},{"rowNumber":3}]` {
+			t.Fatalf("Expected the first three rows, got %s", string(body))
+		}
+	})
+
+	t.Run("GET truncated rows - the rest of the query is canceled rather than read", func(t *testing.T) {
+		for _, headers := range []map[string]string{nil, {constants.TIMEZONE_HEADER: "Asia/Tokyo"}} {
+			// reading the remaining rows would take almost half a minute
+			started := time.Now()
+			body, err, status := CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getSlowTailRows", headers)
+			if err != nil {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, status, string(body))
+			}
+			if elapsed := time.Since(started); elapsed > 3*time.Second {
+				t.Fatalf("Expected the truncated request to return without reading the remaining rows, took %v", elapsed)
+			}
+			if !strings.Contains(string(body), `"rowNumber":1,`) || strings.Count(string(body), `"rowNumber"`) != 3 {
+				t.Fatalf("Expected the first three rows, got %s", string(body))
+			}
+		}
+
+		// the connections the canceled queries ran on are still usable
+		for i := 0; i < 20; i++ {
+			_, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getTruncatedRows")
+			if err != nil || status != http.StatusOK {
+				t.Fatalf("Expected status %d after the canceled queries, got %d: %v", http.StatusOK, status, err)
+			}
+		}
+	})
+
+	t.Run("GET oversized response - maxResponseBytes with ERROR", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getOversizedResponse")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, status)
+		}
+		if !strings.Contains(string(body), string(implementations.ERROR_TOO_LARGE)) {
+			t.Fatalf("Expected the %s code, got %s", implementations.ERROR_TOO_LARGE, string(body))
+		}
+	})
+
+	t.Run("GET raw json documents - json columns embedded verbatim", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getRawJsonDocuments")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, expected := range []string{
+			`"aJson":{"zebra":1,"apple":[1,2.50]}`,
+			`"aJsonb":{"b":{"c":true}}`,
+			`"aNullJsonb":null`,
+			`"anInt":42`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("GET cached timestamp - repeated calls served from the result cache", func(t *testing.T) {
+		first, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=a")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		second, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=a")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if string(first) != string(second) {
+			t.Fatalf("Expected the second call to be served from the cache, got %s then %s", string(first), string(second))
+		}
+
+		other, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=b")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if !strings.Contains(string(other), `"label":"b"`) {
+			t.Fatalf("Expected different parameters to miss the cache, got %s", string(other))
+		}
+	})
+
+	t.Run("GET cached timestamp - parameters are validated before the cache is consulted", func(t *testing.T) {
+		cached, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=c")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=c&extra=1")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest || !strings.Contains(string(body), `"params":["extra"]`) {
+			t.Fatalf("Expected status %d naming the extra parameter, got %d: %s", http.StatusBadRequest, status, string(body))
+		}
+
+		// a NUL in a value must not make it look like another parameter list
+		body, err, status = CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCachedTimestamp?label=c%00extra=1")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if string(body) == string(cached) {
+			t.Fatalf("Expected a value holding a NUL to miss the cached result of another request, got %s", string(body))
+		}
+	})
+
+	t.Run("GET coalesced timestamp - identical concurrent calls share one query", func(t *testing.T) {
+		const callers = 5
+		bodies := make([]string, callers)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCoalescedTimestamp?label=a")
+				if err != nil || status != http.StatusOK {
+					t.Errorf("Failed to call secured queries router via loopback: %v, %d", err, status)
+				}
+				bodies[i] = string(body)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 1; i < callers; i++ {
+			if bodies[i] != bodies[0] {
+				t.Fatalf("Expected concurrent calls to share one query result, got %s and %s", bodies[0], bodies[i])
+			}
+		}
+	})
+
+	t.Run("GET uncoalesced timestamp - methods not marked readOnly each run the query", func(t *testing.T) {
+		const callers = 3
+		bodies := make([]string, callers)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getUncoalescedTimestamp?label=a")
+				if err != nil || status != http.StatusOK {
+					t.Errorf("Failed to call secured queries router via loopback: %v, %d", err, status)
+				}
+				bodies[i] = string(body)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 1; i < callers; i++ {
+			if bodies[i] == bodies[0] {
+				t.Fatalf("Expected each call to run its own query, got %s twice", bodies[0])
+			}
+		}
+	})
+
+	t.Run("GET json by id - matching If-None-Match returns 304", func(t *testing.T) {
+		body, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getJsonById?id=1", nil)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		etag := headers.Get(constants.ETAG_HEADER)
+		if etag == "" {
+			t.Fatalf("Expected an ETag header, got none")
+		}
+
+		ifNoneMatch := map[string]string{constants.IF_NONE_MATCH_HEADER: etag}
+		body, _, err, status = CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getJsonById?id=1", ifNoneMatch)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusNotModified {
+			t.Fatalf("Expected status %d, got %d", http.StatusNotModified, status)
+		}
+		if len(body) != 0 {
+			t.Fatalf("Expected no body with a 304, got %s", string(body))
+		}
+
+		_, err, status = CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getJsonById?id=2", ifNoneMatch)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Expected other results to be returned with status %d, got %v, %d", http.StatusOK, err, status)
+		}
+	})
+
+	t.Run("GET versioned rows - version query ETag and Cache-Control", func(t *testing.T) {
+		_, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getVersionedRows?label=a", nil)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if headers.Get(constants.CACHE_CONTROL_HEADER) != "private, max-age=30" {
+			t.Fatalf("Expected the method's Cache-Control header, got %q", headers.Get(constants.CACHE_CONTROL_HEADER))
+		}
+		etag := headers.Get(constants.ETAG_HEADER)
+
+		// the results change on every call (servedAt), but the version does not
+		_, headers, err, status = CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getVersionedRows?label=a",
+			map[string]string{constants.IF_NONE_MATCH_HEADER: "W/" + etag})
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusNotModified {
+			t.Fatalf("Expected status %d, got %d", http.StatusNotModified, status)
+		}
+		if headers.Get(constants.ETAG_HEADER) != etag {
+			t.Fatalf("Expected the ETag %s to be sent with the 304, got %s", etag, headers.Get(constants.ETAG_HEADER))
+		}
+
+		_, headers, err, status = CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getVersionedRows?label=b",
+			map[string]string{constants.IF_NONE_MATCH_HEADER: etag})
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Expected a different version to return results with status %d, got %v, %d", http.StatusOK, err, status)
+		}
+		if headers.Get(constants.ETAG_HEADER) == etag {
+			t.Fatalf("Expected a different ETag for a different version, got %s", etag)
+		}
+	})
+
+	t.Run("GET series rows - large results are compressed as negotiated", func(t *testing.T) {
+		uncompressed, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getSeriesRows?count=2000")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+
+		for _, encoding := range []string{"gzip", "br", "zstd"} {
+			body, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getSeriesRows?count=2000",
+				map[string]string{"Accept-Encoding": encoding})
+			if err != nil || status != http.StatusOK {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if headers.Get("Content-Encoding") != encoding {
+				t.Fatalf("Expected Content-Encoding %s, got %q", encoding, headers.Get("Content-Encoding"))
+			}
+			if len(body) >= len(uncompressed) {
+				t.Fatalf("Expected the %s body to be smaller than %d bytes, got %d", encoding, len(uncompressed), len(body))
+			}
+
+			var reader io.Reader
+			switch encoding {
+			case "gzip":
+				reader, err = gzip.NewReader(bytes.NewReader(body))
+			case "br":
+				reader = brotli.NewReader(bytes.NewReader(body))
+			case "zstd":
+				reader, err = zstd.NewReader(bytes.NewReader(body))
+			}
+			if err != nil {
+				t.Fatalf("Failed to open the %s body: %v", encoding, err)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Failed to decode the %s body: %v", encoding, err)
+			}
+			if !bytes.Equal(decoded, uncompressed) {
+				t.Fatalf("Expected the decoded %s body to match the uncompressed results", encoding)
+			}
+		}
+
+		_, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getSeriesRows?count=1",
+			map[string]string{"Accept-Encoding": "gzip"})
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if headers.Get("Content-Encoding") != "" {
+			t.Fatalf("Expected a response under the threshold to be sent uncompressed, got %s", headers.Get("Content-Encoding"))
+		}
+	})
+
+	t.Run("Compression - a body written in parts with flushes is compressed as it is sent", func(t *testing.T) {
+		compression, err := queryhelpers.NewResponseCompression(viper.New())
+		if err != nil {
+			t.Fatalf("Failed to create the response compression: %v", err)
+		}
+		parts := [][]byte{
+			bytes.Repeat([]byte(`{"part":1},`), 50),
+			bytes.Repeat([]byte(`{"part":2},`), 200),
+			bytes.Repeat([]byte(`{"part":3},`), 200),
+		}
+
+		for _, encoding := range []string{"gzip", "br", "zstd"} {
+			request := httptest.NewRequest(http.MethodGet, "/v1/queries/unittests/getSeriesRows", nil)
+			request.Header.Set("Accept-Encoding", encoding)
+			recorder := httptest.NewRecorder()
+
+			writer := compression.Wrap(recorder, request)
+			for i, part := range parts {
+				if _, err := writer.Write(part); err != nil {
+					t.Fatalf("Failed to write part %d: %v", i+1, err)
+				}
+				writer.Flush()
+				// the first part is under the threshold, but the flush still sends it, compressed
+				if recorder.Body.Len() == 0 {
+					t.Fatalf("Expected the %s stream to be sent on the flush after part %d", encoding, i+1)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Failed to close the %s writer: %v", encoding, err)
+			}
+
+			if recorder.Header().Get("Content-Encoding") != encoding {
+				t.Fatalf("Expected Content-Encoding %s, got %q", encoding, recorder.Header().Get("Content-Encoding"))
+			}
+			var reader io.Reader
+			switch encoding {
+			case "gzip":
+				reader, err = gzip.NewReader(recorder.Body)
+			case "br":
+				reader = brotli.NewReader(recorder.Body)
+			case "zstd":
+				reader, err = zstd.NewReader(recorder.Body)
+			}
+			if err != nil {
+				t.Fatalf("Failed to open the %s body: %v", encoding, err)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Failed to decode the %s body: %v", encoding, err)
+			}
+			if !bytes.Equal(decoded, bytes.Join(parts, nil)) {
+				t.Fatalf("Expected the decoded %s body to be the parts written", encoding)
+			}
+		}
+	})
+
+	t.Run("GET failover rows - a replica that loses its connection is retried on the primary", func(t *testing.T) {
+		hook := logtest.NewLocal(router.Logger)
+
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/failover/getFailoverRows")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, status, string(body))
+		}
+		if !strings.Contains(string(body), `"servedBy":"primary"`) {
+			t.Fatalf("Expected the retry to be served by the primary, got %s", string(body))
+		}
+
+		// the slow-query log names (and explains on) the pool the retry ran on, not the failed replica
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, entry := range hook.AllEntries() {
+				if entry.Data["logger"] != "slow-query" || entry.Data["method"] != "getFailoverRows" {
+					continue
+				}
+				if entry.Data["pool"] != "failover/primary" {
+					t.Fatalf("Expected the slow query to be logged on failover/primary, got %v", entry.Data["pool"])
+				}
+				if plan, _ := entry.Data["plan"].(string); plan == "" {
+					t.Fatalf("Expected the entry to carry the query plan, got %v", entry.Data)
+				}
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Expected a slow-query log entry for getFailoverRows")
+	})
+
+	t.Run("GET replica rows - replica consistency falls back to the primary without replicas", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getReplicaRows?count=3")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `"onReplica":false`) {
+			t.Fatalf("Expected the query to run on the primary, got %s", string(body))
+		}
+	})
+
+	t.Run("GET datasource name - serviceName bound to a named datasource", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/reporting/getDatasourceName")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `"database":`) {
+			t.Fatalf("Expected body to contain the database name, got %s", string(body))
+		}
+
+		metrics, err, status := CallServiceViaLoopback(router.Configuration, "metrics")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call metrics router via loopback: %v, %d", err, status)
+		}
+		if !strings.Contains(string(metrics), `siftd_queryservice_pool_acquires_total{pool="reporting/primary",store="secured"}`) {
+			t.Fatalf("Expected pool stats for the reporting datasource, got %s", string(metrics))
+		}
+	})
+
+	t.Run("GET shard rows - routed by the shard key", func(t *testing.T) {
+		for _, region := range []string{"US-EAST", "us-west", "eu-central"} {
+			body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getShardRows?region="+region)
+			if err != nil {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+			if !strings.Contains(string(body), `"region":"`+region+`"`) {
+				t.Fatalf("Expected body to contain the region %s, got %s", region, string(body))
+			}
+		}
+	})
+
+	t.Run("GET scattered rows - shard results merged in order and limited", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getScatteredRows?count=3")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if string(body) != `[{"n":3},{"n":3},{"n":2},{"n":2}]` {
+			t.Fatalf("Expected the rows of both shards merged largest first and cut to 4, got %s", string(body))
+		}
+	})
+
+	t.Run("GET divided rows - query errors are not retried", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getDividedRows?divisor=2")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK || string(body) != `[{"quotient":5}]` {
+			t.Fatalf("Expected status %d with the quotient, got %d: %s", http.StatusOK, status, string(body))
+		}
+
+		// division by zero (SQLSTATE 22012) is not transient, so the request fails on the first attempt
+		_, err, status = CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getDividedRows?divisor=0")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+
+		metrics, err, status := CallServiceViaLoopback(router.Configuration, "metrics")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call metrics router via loopback: %v, %d", err, status)
+		}
+		if strings.Contains(string(metrics), `siftd_queryservice_query_retries_total{method="getDividedRows"`) {
+			t.Fatalf("Expected no retries of getDividedRows, got %s", string(metrics))
+		}
+	})
+
+	t.Run("GET health - circuit breakers reported closed", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/health")
+		if err != nil {
+			t.Fatalf("Failed to call health router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		for _, circuit := range []string{`"database-circuit":"CLOSED"`, `"database-reporting/circuit":"CLOSED"`} {
+			if !strings.Contains(string(body), circuit) {
+				t.Fatalf("Expected health to report %s, got %s", circuit, string(body))
+			}
+		}
+
+		metrics, err, status := CallServiceViaLoopback(router.Configuration, "metrics")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Failed to call metrics router via loopback: %v, %d", err, status)
+		}
+		if !strings.Contains(string(metrics), `siftd_queryservice_circuit_breaker_state{datasource="default"} 0`) {
+			t.Fatalf("Expected the default datasource's circuit breaker state, got %s", string(metrics))
+		}
+	})
+
+	t.Run("GET rate limited rows - 429 with Retry-After once the burst is used up", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, _, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getRateLimitedRows", nil)
+			if err != nil {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if status != http.StatusOK {
+				t.Fatalf("Expected status %d for request %d of the burst, got %d", http.StatusOK, i+1, status)
+			}
+		}
+
+		body, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/unittests/getRateLimitedRows", nil)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusTooManyRequests {
+			t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, status)
+		}
+		if !strings.Contains(string(body), `"code":"RATE_LIMITED"`) {
+			t.Fatalf("Expected a RATE_LIMITED error, got %s", string(body))
+		}
+		if retryAfter := headers.Get(constants.RETRY_AFTER_HEADER); retryAfter != "2" {
+			t.Fatalf("Expected a Retry-After of 2 seconds, got %q", retryAfter)
+		}
+	})
+
+	t.Run("GET slow rows - logged with redacted parameters and the query plan", func(t *testing.T) {
+		hook := logtest.NewLocal(router.Logger)
+
+		_, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getSlowRows?note=secret")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+
+		// the plan is fetched after the response has been sent
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, entry := range hook.AllEntries() {
+				if entry.Data["logger"] != "slow-query" || entry.Data["method"] != "getSlowRows" {
+					continue
+				}
+				if params, _ := entry.Data["params"].(map[string]string); params["note"] != "[REDACTED]" {
+					t.Fatalf("Expected the note parameter to be redacted, got %v", entry.Data["params"])
+				}
+				plan, _ := entry.Data["plan"].(string)
+				if !strings.Contains(plan, "Result") {
+					t.Fatalf("Expected the entry to carry the query plan, got %v", entry.Data)
+				}
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Expected a slow-query log entry for getSlowRows")
+	})
+
+	t.Run("GET raised SQLSTATEs - mapped to the documented http statuses", func(t *testing.T) {
+		sqlstates := []struct {
+			code   string
+			status int
+			error  string
+		}{
+			{"22012", http.StatusBadRequest, "INVALID_PARAMS"},
+			{"22P02", http.StatusBadRequest, "INVALID_PARAMS"},
+			{"57014", http.StatusGatewayTimeout, "TIMEOUT"},
+			{"08006", http.StatusServiceUnavailable, "UNAVAILABLE"},
+			{"53300", http.StatusServiceUnavailable, "UNAVAILABLE"},
+			{"57P01", http.StatusServiceUnavailable, "UNAVAILABLE"},
+			{"57P02", http.StatusServiceUnavailable, "UNAVAILABLE"},
+			{"57P03", http.StatusServiceUnavailable, "UNAVAILABLE"},
+			{"42P01", http.StatusInternalServerError, "BACKEND_ERROR"},
+		}
+		for _, sqlstate := range sqlstates {
+			body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/sqlstates/raiseSqlState?code="+sqlstate.code)
+			if err != nil {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if status != sqlstate.status {
+				t.Fatalf("Expected status %d for SQLSTATE %s, got %d: %s", sqlstate.status, sqlstate.code, status, string(body))
+			}
+			if !strings.Contains(string(body), `"code":"`+sqlstate.error+`"`) {
+				t.Fatalf("Expected a %s error for SQLSTATE %s, got %s", sqlstate.error, sqlstate.code, string(body))
+			}
+
+			// a success in between keeps the datasource's circuit breaker closed
+			_, err, status = CallServiceViaLoopback(router.Configuration, "v1/queries/sqlstates/raiseSqlState?code=00000")
+			if err != nil || status != http.StatusOK {
+				t.Fatalf("Expected status %d after SQLSTATE %s, got %d: %v", http.StatusOK, sqlstate.code, status, err)
+			}
+		}
+	})
+
+	t.Run("GET raised SQLSTATEs - a retried request counts once against the circuit breaker", func(t *testing.T) {
+		// each request is tried three times; counted per attempt, two requests would open the circuit
+		for i := 0; i < 2; i++ {
+			_, headers, err, status := CallServiceViaLoopbackForHeaders(router.Configuration, "v1/queries/sqlstates/raiseSqlState?code=08006", nil)
+			if err != nil {
+				t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+			}
+			if status != http.StatusServiceUnavailable || headers.Get(constants.RETRY_AFTER_HEADER) != "" {
+				t.Fatalf("Expected the database's own failure, got %d with Retry-After %q", status, headers.Get(constants.RETRY_AFTER_HEADER))
+			}
+		}
+
+		_, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/sqlstates/raiseSqlState?code=00000")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("Expected the circuit to stay closed, got %d: %v", status, err)
+		}
+	})
+
+	t.Run("GET missing database function - logged with the undefined function marker", func(t *testing.T) {
+		hook := logtest.NewLocal(router.Logger)
+
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/sqlstates/callMissingFunction")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusInternalServerError {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusInternalServerError, status, string(body))
+		}
+
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["sqlstate"] == "42883" {
+				if entry.Data["marker"] != implementations.LOG_MARKER_UNDEFINED_DATABASE_FUNCTION {
+					t.Fatalf("Expected the %s marker, got %v", implementations.LOG_MARKER_UNDEFINED_DATABASE_FUNCTION, entry.Data)
+				}
+				return
+			}
+		}
+		t.Fatalf("Expected a log entry for SQLSTATE 42883")
+	})
+
+	t.Run("GET custom types - enums, domains and composites encoded as their values", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries/unittests/getCustomTypes")
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, status, string(body))
+		}
+		for _, expected := range []string{
+			`"mood":"happy"`,
+			`"moods":["sad","ok"]`,
+			`"rating":5`,
+			`"ratings":[1,2]`,
+			`"address":{"mood":"ok","rating":3,"street":"Main St"}`,
+		} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected body to contain %s, got %s", expected, string(body))
+			}
+		}
+	})
+
+	t.Run("Startup - a custom type missing from the database fails the store", func(t *testing.T) {
+		configuration := viper.New()
+		configuration.Set(constants.DB_CONNECTION_STRING, router.Configuration.GetString(constants.DB_CONNECTION_STRING))
+		configuration.Set(constants.DB_CUSTOM_TYPES, `["mood","no_such_type"]`)
+
+		_, err := implementations.NewBaseQueryStore(configuration, router.Logger, "healthcheck:skip-load")
+		if err == nil {
+			t.Fatalf("Expected the store to fail on the missing custom type")
+		}
+		if !strings.Contains(err.Error(), "custom type no_such_type") || !strings.Contains(err.Error(), "was not found") {
+			t.Fatalf("Expected an error naming the missing custom type, got %v", err)
+		}
+
+		// a named datasource registers the types listed for it, not DB_CUSTOM_TYPES
+		configuration.Set(constants.DB_CUSTOM_TYPES, `["mood"]`)
+		configuration.Set(constants.DATASOURCES+".extra."+constants.DATASOURCE_CONNECTSTRING, router.Configuration.GetString(constants.DB_CONNECTION_STRING))
+		configuration.Set(constants.DATASOURCES+".extra."+constants.DATASOURCE_CUSTOM_TYPES, `["no_such_type"]`)
+		_, err = implementations.NewBaseQueryStore(configuration, router.Logger, "healthcheck:skip-load")
+		if err == nil {
+			t.Fatalf("Expected the store to fail on the missing custom type of the extra datasource")
+		}
+		if !strings.Contains(err.Error(), "custom type no_such_type listed in DATASOURCES.extra.customtypes") {
+			t.Fatalf("Expected an error naming the datasource's setting, got %v", err)
+		}
+	})
+
+	t.Run("Startup - named datasources load from dotted keys in an env file", func(t *testing.T) {
+		connectString := router.Configuration.GetString(constants.DB_CONNECTION_STRING)
+		configuration := viper.New()
+		configuration.SetConfigType("env")
+		err := configuration.ReadConfig(strings.NewReader(
+			constants.DB_CONNECTION_STRING + "=\"" + connectString + "\"\n" +
+				constants.DATASOURCES + ".reporting." + constants.DATASOURCE_CONNECTSTRING + "=\"" + connectString + "\"\n"))
+		if err != nil {
+			t.Fatalf("Failed to read the env config: %v", err)
+		}
+
+		store, err := implementations.NewBaseQueryStore(configuration, router.Logger, "healthcheck:skip-load")
+		if err != nil {
+			t.Fatalf("Expected the store to start, got %v", err)
+		}
+		health := store.PoolHealthCheck()
+		if len(health) != 1 || health[0].Name != "reporting/primary" || health[0].Err != nil {
+			t.Fatalf("Expected a healthy reporting/primary pool, got %+v", health)
+		}
+
+		// a datasource without a connection string names the keys found for it, so a typo can be spotted
+		configuration = viper.New()
+		configuration.SetConfigType("env")
+		err = configuration.ReadConfig(strings.NewReader(
+			constants.DB_CONNECTION_STRING + "=\"" + connectString + "\"\n" +
+				constants.DATASOURCES + ".reporting.connectstrng=\"" + connectString + "\"\n"))
+		if err != nil {
+			t.Fatalf("Failed to read the env config: %v", err)
+		}
+		_, err = implementations.NewBaseQueryStore(configuration, router.Logger, "healthcheck:skip-load")
+		if err == nil {
+			t.Fatalf("Expected the store to fail on the misspelled connection string")
+		}
+		if !strings.Contains(err.Error(), "datasources.reporting.connectstrng") {
+			t.Fatalf("Expected an error naming the keys found for the datasource, got %v", err)
+		}
+	})
+
+	t.Run("PostGIS - GeoJSON results and parameters", func(t *testing.T) {
+		configuration := viper.New()
+		configuration.Set(constants.DB_CONNECTION_STRING, router.Configuration.GetString(constants.DB_CONNECTION_STRING))
+		configuration.Set(constants.POSTGIS_ENABLED, true)
+
+		store, err := implementations.NewBaseQueryStore(configuration, router.Logger,
+			router.Configuration.GetString("RESDIR_PATH")+"/Resources/PostGIS.Queries.json")
+		if err != nil {
+			if strings.Contains(err.Error(), "postgis extension is not installed") {
+				t.Skipf("Skipping, the test database has no postgis: %v", err)
+			}
+			t.Fatalf("Failed to create the PostGIS query store: %v", err)
+		}
+		ctx := context.Background()
+
+		body, err := store.RunStandAloneQueryWithContext(ctx, "postgis", "getGeometries", map[string]string{})
+		if err != nil {
+			t.Fatalf("Failed to query geometries: %v", err)
+		}
+		if !strings.Contains(string(body), `"point":{"type":"Point","coordinates":[1,2]}`) {
+			t.Fatalf("Expected the WGS 84 point as plain GeoJSON, got %s", string(body))
+		}
+		if !strings.Contains(string(body), `"projected":{"type":"Point","crs":{"type":"name","properties":{"name":"EPSG:3857"}},"coordinates":[100,200]}`) {
+			t.Fatalf("Expected the projected point to name its SRID, got %s", string(body))
+		}
+
+		body, err = store.RunStandAloneQueryWithContext(ctx, "postgis", "getShapeArea", map[string]string{
+			"shape": `{"type":"Polygon","coordinates":[[[0,0],[2,0],[2,2],[0,2],[0,0]]]}`,
+		})
+		if err != nil {
+			t.Fatalf("Failed to query with a GeoJSON parameter: %v", err)
+		}
+		if !strings.Contains(string(body), `"area":4`) || !strings.Contains(string(body), `"srid":4326`) {
+			t.Fatalf("Expected the area and SRID of the shape, got %s", string(body))
+		}
+
+		_, err = store.RunStandAloneQueryWithContext(ctx, "postgis", "getShapeArea", map[string]string{
+			"shape": `{"type":"Polygon","coordinates":"not coordinates"}`,
+		})
+		var queryErr *implementations.QueryError
+		if !errors.As(err, &queryErr) || queryErr.Code != implementations.ERROR_INVALID_PARAMS {
+			t.Fatalf("Expected an INVALID_PARAMS error for a malformed shape, got %v", err)
+		}
+		if len(queryErr.Params) != 1 || queryErr.Params[0] != "shape" {
+			t.Fatalf("Expected the error to name the shape parameter, got %v", queryErr.Params)
+		}
+	})
+
+	t.Run("Retry policy - circuit breakers require an acquire timeout", func(t *testing.T) {
+		configuration := viper.New()
+		policy, err := implementations.NewRetryPolicy(configuration)
+		if err != nil || policy.AcquireTimeout <= 0 {
+			t.Fatalf("Expected a default acquire timeout while circuit breakers are on, got %v: %v", policy.AcquireTimeout, err)
+		}
+
+		configuration.Set(constants.DB_ACQUIRE_TIMEOUT_MS, 0)
+		if _, err := implementations.NewRetryPolicy(configuration); err == nil {
+			t.Fatalf("Expected an acquire timeout of 0 to be rejected while circuit breakers are on")
+		}
+
+		configuration.Set(constants.CIRCUIT_BREAKER_FAILURES, 0)
+		configuration.Set(constants.CIRCUIT_BREAKER_ERROR_RATE, 0)
+		policy, err = implementations.NewRetryPolicy(configuration)
+		if err != nil || policy.AcquireTimeout != 0 {
+			t.Fatalf("Expected no acquire timeout with circuit breakers off, got %v: %v", policy.AcquireTimeout, err)
+		}
+	})
+
 	t.Run("GET private/secured queries request - valid request", func(t *testing.T) {
 		body, err, status := CallServiceViaLoopback(router.Configuration, "v1/queries")
 		if err != nil {
@@ -143,6 +1174,54 @@ func TestCalls(t *testing.T) {
 			t.Fatalf("Expected body to contain 'aJson' root node in json returned, got %s", string(body))
 		}
 	})
+
+	t.Run("GET json by id - spans continue the incoming traceparent", func(t *testing.T) {
+		spanExporter.Reset()
+
+		traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+		headers := map[string]string{"traceparent": "00-" + traceId + "-00f067aa0ba902b7-01"}
+		_, err, status := CallServiceViaLoopbackWithHeaders(router.Configuration, "v1/queries/unittests/getJsonById?id=1", headers)
+		if err != nil {
+			t.Fatalf("Failed to call secured queries router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+
+		// the request span is ended after the response is written, so give it a moment to arrive
+		expected := []string{"queryservice.request", "queryservice.params.parse", "queryservice.pool.acquire", "queryservice.query.execute", "queryservice.json.encode"}
+		found := map[string]bool{}
+		for i := 0; i < 20 && len(found) < len(expected); i++ {
+			for _, span := range spanExporter.GetSpans() {
+				if span.SpanContext.TraceID().String() != traceId {
+					t.Fatalf("Expected span %s to be part of trace %s, got %s", span.Name, traceId, span.SpanContext.TraceID().String())
+				}
+				found[span.Name] = true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		for _, name := range expected {
+			if !found[name] {
+				t.Fatalf("Expected a %s span to be exported, got %v", name, found)
+			}
+		}
+	})
+
+	t.Run("GET metrics - query and pool stats exposed", func(t *testing.T) {
+		body, err, status := CallServiceViaLoopback(router.Configuration, "metrics")
+		if err != nil {
+			t.Fatalf("Failed to call metrics router via loopback: %v, %d", err, status)
+		}
+		if status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if !strings.Contains(string(body), `siftd_queryservice_requests_total{method="getJsonById"`) {
+			t.Fatalf("Expected body to contain request counts for getJsonById, got %s", string(body))
+		}
+		if !strings.Contains(string(body), `siftd_queryservice_pool_acquired_connections{pool="primary",store="public"}`) {
+			t.Fatalf("Expected body to contain pool stats for the public store, got %s", string(body))
+		}
+	})
 }
 
 func TestShutdownListener(t *testing.T) {
@@ -170,6 +1249,26 @@ func NewQueriesService() (*queryhelpers.PublicQueriesRouter, error) {
 		return nil, fmt.Errorf("Failed to validate configuration and listen. Shutting down.")
 	}
 
+	// a named datasource for the datasource tests, pointed at the same test database
+	queryService.Configuration.Set(constants.DATASOURCES+".reporting."+constants.DATASOURCE_CONNECTSTRING,
+		queryService.Configuration.GetString(constants.DB_CONNECTION_STRING))
+	// a datasource of its own for the database error tests, so their failures trip no other circuit breaker
+	queryService.Configuration.Set(constants.DATASOURCES+".sqlstates."+constants.DATASOURCE_CONNECTSTRING,
+		queryService.Configuration.GetString(constants.DB_CONNECTION_STRING))
+	// a datasource whose replica (the same database, told apart by application_name) fails every
+	// query with a lost connection, for the replica failover test
+	queryService.Configuration.Set(constants.DATASOURCES+".failover."+constants.DATASOURCE_CONNECTSTRING,
+		queryService.Configuration.GetString(constants.DB_CONNECTION_STRING))
+	queryService.Configuration.Set(constants.DATASOURCES+".failover."+constants.DATASOURCE_REPLICAS,
+		queryService.Configuration.GetString(constants.DB_CONNECTION_STRING)+" application_name=failover-replica")
+	// two shards for the shard routing tests: the default database and the reporting datasource
+	queryService.Configuration.Set(constants.SHARD_DATASOURCES, `["default","reporting"]`)
+	// the user-defined types of the custom type tests (created by create_DB-Resource-Journal.sql)
+	queryService.Configuration.Set(constants.DB_CUSTOM_TYPES, `["mood","positive_int","address"]`)
+	// a slow-query log with plans for the slow-query test (getSlowRows sleeps past the threshold)
+	queryService.Configuration.Set(constants.SLOW_QUERY_THRESHOLD_MS, 200)
+	queryService.Configuration.Set(constants.SLOW_QUERY_EXPLAIN, true)
+
 	PublicQueriesRouter := queryhelpers.NewPublicQueriesRouter(queryService, policyTranslation)
 	//security.NO_REALM, security.NO_AUTH, security.NO_EXPIRY, nil)
 	if PublicQueriesRouter == nil {
@@ -187,6 +1286,11 @@ func NewQueriesService() (*queryhelpers.PublicQueriesRouter, error) {
 		return nil, fmt.Errorf("Failed to create health check api server. Shutting down.")
 	}
 
+	MetricsRouter := queryhelpers.NewMetricsRouter(queryService, security.NO_REALM, security.NO_AUTH, security.NO_EXPIRY, nil)
+	if MetricsRouter == nil {
+		return nil, fmt.Errorf("Failed to create metrics api server. Shutting down.")
+	}
+
 	/*
 		// setup
 		listenAddress := queryService.Configuration.GetString(constants.LISTEN_ADDRESS)
@@ -211,18 +1315,31 @@ func NewQueriesService() (*queryhelpers.PublicQueriesRouter, error) {
 }
 
 func CallServiceViaLoopback(configuration *viper.Viper, requestURLSuffix string) ([]byte, error, int) {
+	return CallServiceViaLoopbackWithHeaders(configuration, requestURLSuffix, nil)
+}
+
+func CallServiceViaLoopbackWithHeaders(configuration *viper.Viper, requestURLSuffix string, headers map[string]string) ([]byte, error, int) {
+	body, _, err, status := CallServiceViaLoopbackForHeaders(configuration, requestURLSuffix, headers)
+	return body, err, status
+}
+
+// CallServiceViaLoopbackForHeaders also returns the response headers
+func CallServiceViaLoopbackForHeaders(configuration *viper.Viper, requestURLSuffix string, headers map[string]string) ([]byte, http.Header, error, int) {
 
 	listenAddress := configuration.GetString(constants.LISTEN_ADDRESS)
 	if listenAddress == "" {
 		err := fmt.Errorf("Unable to retrieve listen address and port. Shutting down.")
-		return nil, err, http.StatusBadRequest
+		return nil, nil, err, http.StatusBadRequest
 	}
 	requestURL := fmt.Sprintf("%s/%s", listenAddress, requestURLSuffix)
 
 	req, err := http.NewRequest(constants.HTTP_GET, requestURL, nil)
 	if err != nil {
 		err = fmt.Errorf("failed to build noun service request in UnitTest: %s", err)
-		return nil, err, http.StatusBadRequest
+		return nil, nil, err, http.StatusBadRequest
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
 	}
 	//	if (fakeUserToken != nil) && (len(fakeUserToken) > 0) {
 	//		req.Header.Add("Authorization", string(fakeUserToken))
@@ -231,14 +1348,14 @@ func CallServiceViaLoopback(configuration *viper.Viper, requestURLSuffix string)
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		err = fmt.Errorf("client call to noun service failed with : %s", err)
-		return nil, err, http.StatusBadRequest
+		return nil, nil, err, http.StatusBadRequest
 	}
 
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
 		err = fmt.Errorf("unable to read noun service reply: %s", err)
-		return nil, err, http.StatusBadRequest
+		return nil, nil, err, http.StatusBadRequest
 	}
 
-	return resBody, err, res.StatusCode
+	return resBody, res.Header, err, res.StatusCode
 }